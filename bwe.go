@@ -0,0 +1,209 @@
+package percy
+
+import (
+	"sort"
+	"time"
+)
+
+// Bandwidth estimation.  The MD estimates how much each receiver can take,
+// tells the SFU, and tells each sender (with REMB) how much the worst of
+// its receivers can take -- or, for a simulcast sender, the best, since
+// the SFU moves the others to lower layers.  Receivers' own REMBs are
+// consumed here rather than forwarded, since a sender can't do anything
+// sensible with a dozen different estimates.
+//
+// An estimate combines two signals:
+//
+// * The receiver's own REMB, which is usually delay-based and the better
+//   of the two when it is available.
+//
+// * Loss reported in the receiver's RTCP, less the loss the MD itself saw
+//   from the sender, as a rough loss-based controller: back off when more
+//   than 10% is lost on the last hop, and probe upward when less than 2%,
+//   but never to more than half as much again as was actually sent.
+//
+// Transport-wide congestion control would need the MD to number packets
+// in a header extension of its own, which it can't do in PERC: the inner
+// layer authenticates the sender's header extensions.
+//
+// https://tools.ietf.org/html/draft-alvestrand-rmcat-remb
+// https://tools.ietf.org/html/draft-ietf-rmcat-gcc-02#section-6
+
+const (
+	bweLossHigh      = 0.10
+	bweLossLow       = 0.02
+	bweIncrease      = 1.08
+	bweRateCap       = 1.5 // the most the estimate can be, relative to the send rate
+	bweREMBTimeout   = 5 * time.Second
+	bweMinimumPeriod = 100 * time.Millisecond
+)
+
+type bandwidthEstimator struct {
+	remb     uint64
+	rembTime time.Time
+
+	loss uint64 // loss-based estimate, zero until there is one
+
+	// What the MD has sent to the receiver since the last report
+	sentBytes uint64
+	sentSince time.Time
+}
+
+func (bwe *bandwidthEstimator) sent(bytes int, now time.Time) {
+	if bwe.sentSince.IsZero() {
+		bwe.sentSince = now
+	}
+	bwe.sentBytes += uint64(bytes)
+}
+
+func (bwe *bandwidthEstimator) receiverREMB(bitrate uint64, now time.Time) {
+	bwe.remb = bitrate
+	bwe.rembTime = now
+}
+
+// Update the loss-based estimate from the fraction of packets (out of 256)
+// lost on the way to the receiver
+func (bwe *bandwidthEstimator) receiverReport(fractionLost uint8, now time.Time) {
+	period := now.Sub(bwe.sentSince)
+	if bwe.sentSince.IsZero() || period < bweMinimumPeriod {
+		return
+	}
+
+	rate := uint64(float64(bwe.sentBytes*8) / period.Seconds())
+	bwe.sentBytes = 0
+	bwe.sentSince = now
+
+	loss := float64(fractionLost) / 256
+	switch {
+	case loss > bweLossHigh:
+		bwe.loss = uint64(float64(rate) * (1 - loss/2))
+
+	case loss < bweLossLow:
+		base := bwe.loss
+		if rate > base {
+			base = rate
+		}
+		bwe.loss = uint64(float64(base) * bweIncrease)
+		if limit := uint64(float64(rate) * bweRateCap); bwe.loss > limit {
+			bwe.loss = limit
+		}
+
+	case bwe.loss == 0:
+		bwe.loss = rate
+	}
+}
+
+// The current estimate, if there is one
+func (bwe *bandwidthEstimator) estimate(now time.Time) (uint64, bool) {
+	var est uint64
+	ok := false
+
+	if bwe.remb > 0 && now.Sub(bwe.rembTime) < bweREMBTimeout {
+		est, ok = bwe.remb, true
+	}
+
+	if bwe.loss > 0 && (!ok || bwe.loss < est) {
+		est, ok = bwe.loss, true
+	}
+
+	return est, ok
+}
+
+//////////
+
+func (mdd *MDD) estimator(assocID AssociationID) *bandwidthEstimator {
+	bwe, ok := mdd.bwe[assocID]
+	if !ok {
+		bwe = &bandwidthEstimator{}
+		mdd.bwe[assocID] = bwe
+	}
+	return bwe
+}
+
+// Process the report blocks a receiver sent about the sources it gets from
+// the MD
+func (mdd *MDD) receiverLoss(assocID AssociationID, blocks []reportBlock, now time.Time) {
+	if len(blocks) == 0 {
+		return
+	}
+
+	// The receiver's loss includes whatever was lost on the way to the MD,
+	// which isn't the receiver's problem
+	var worst int
+	for _, rb := range blocks {
+		loss := int(rb.fractionLost)
+		if owner, ok := mdd.ssrcOwners[rb.ssrc]; ok {
+			if stats, ok := mdd.recvStats[mediaSource{owner, rb.ssrc}]; ok {
+				loss -= int(stats.fractionLost)
+			}
+		}
+
+		if loss > worst {
+			worst = loss
+		}
+	}
+
+	mdd.estimator(assocID).receiverReport(uint8(worst), now)
+	mdd.updateBandwidth(assocID, now)
+}
+
+func (mdd *MDD) receiverREMB(assocID AssociationID, pkt rtcpPacket, now time.Time) {
+	mdd.estimator(assocID).receiverREMB(pkt.rembBitrate(), now)
+	mdd.updateBandwidth(assocID, now)
+}
+
+func (mdd *MDD) updateBandwidth(assocID AssociationID, now time.Time) {
+	if est, ok := mdd.estimator(assocID).estimate(now); ok && mdd.SFU != nil {
+		mdd.SFU.SetBandwidth(ClientID(assocID), est)
+	}
+}
+
+// A REMB for a sender's video, capped by the worst of the receivers it is
+// being forwarded to (the best for simulcast), or nil if none of them has
+// an estimate
+func (mdd *MDD) senderREMB(assocID AssociationID, now time.Time) rtcpPacket {
+	if mdd.SFU == nil {
+		return nil
+	}
+
+	var ssrcs []uint32
+	for src, stats := range mdd.recvStats {
+		if src.assocID == assocID && stats.clockRate == videoClockRate {
+			ssrcs = append(ssrcs, src.ssrc)
+		}
+	}
+	if len(ssrcs) == 0 {
+		return nil
+	}
+	sort.Slice(ssrcs, func(i, j int) bool { return ssrcs[i] < ssrcs[j] })
+
+	_, simulcast := mdd.simulcast[assocID]
+
+	var bitrate uint64
+	known := false
+	for _, dest := range mdd.SFU.GetFibEntry(ClientID(assocID), 0) {
+		bwe, ok := mdd.bwe[AssociationID(dest.clientID)]
+		if !ok {
+			continue
+		}
+
+		est, ok := bwe.estimate(now)
+		if !ok {
+			continue
+		}
+
+		better := est < bitrate
+		if simulcast {
+			better = est > bitrate
+		}
+
+		if !known || better {
+			bitrate, known = est, true
+		}
+	}
+
+	if !known {
+		return nil
+	}
+	return newREMB(mdd.ssrc, bitrate, ssrcs)
+}
@@ -0,0 +1,68 @@
+package percy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+func TestBandwidthEstimator(t *testing.T) {
+	now := time.Now()
+	bwe := &bandwidthEstimator{}
+
+	_, ok := bwe.estimate(now)
+	assert.True(t, !ok, "Estimate with no information")
+
+	// 1 Mbps with moderate loss holds at the send rate
+	bwe.sent(125000, now)
+	now = now.Add(time.Second)
+	bwe.receiverReport(13, now)
+	est, ok := bwe.estimate(now)
+	assert.True(t, ok, "No loss-based estimate")
+	assert.Equal(t, est, uint64(1000000), "Wrong initial estimate")
+
+	// No loss probes upward
+	bwe.sent(125000, now)
+	now = now.Add(time.Second)
+	bwe.receiverReport(0, now)
+	est, _ = bwe.estimate(now)
+	assert.Equal(t, est, uint64(1080000), "Estimate did not increase")
+
+	// Heavy loss backs off from the send rate
+	bwe.sent(125000, now)
+	now = now.Add(time.Second)
+	bwe.receiverReport(128, now)
+	est, _ = bwe.estimate(now)
+	assert.Equal(t, est, uint64(750000), "Estimate did not back off")
+
+	// A lower REMB wins, until it gets old
+	bwe.receiverREMB(300000, now)
+	est, _ = bwe.estimate(now)
+	assert.Equal(t, est, uint64(300000), "REMB not used")
+
+	est, _ = bwe.estimate(now.Add(bweREMBTimeout))
+	assert.Equal(t, est, uint64(750000), "Stale REMB used")
+
+	// Reports too close together are ignored
+	bwe.sent(125000, now)
+	bwe.receiverReport(255, now.Add(bweMinimumPeriod/2))
+	est, _ = bwe.estimate(now.Add(bweREMBTimeout))
+	assert.Equal(t, est, uint64(750000), "Estimate changed too quickly")
+}
+
+func TestBandwidthEstimatorCap(t *testing.T) {
+	now := time.Now()
+	bwe := &bandwidthEstimator{}
+
+	// Without loss, the estimate climbs no higher than the rate actually
+	// sent allows
+	for i := 0; i < 20; i += 1 {
+		bwe.sent(125000, now)
+		now = now.Add(time.Second)
+		bwe.receiverReport(0, now)
+	}
+
+	est, _ := bwe.estimate(now)
+	assert.Equal(t, est, uint64(1500000), "Estimate not capped at the send rate")
+}
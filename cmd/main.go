@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -23,6 +26,11 @@ var (
 	jsFilename   = "../static/index.js"
 	portField    = "RELAY_PORT_FROM_GO_SERVER"
 	kdServer     = "localhost:4433"
+	kdTunnel     = "udp"
+	kdCAFilename = "../static/cert.pem"
+	iceUfrag     = "fedcbafe"
+	icePwd       = "abcdefabcdefabcdefabcdefabcdefab"
+	confID       = percy.ConfID(1)
 	sdp_offer    = []byte("{\"type\": \"sdp\", \"data\":\"v=0\\r\\n" +
 		"o=percy0.3 2633292546686233323 0 IN IP4 0.0.0.0\\r\\n" +
 		"s=-\\r\\n" +
@@ -38,8 +46,8 @@ var (
 		"a=extmap:1 urn:ietf:params:rtp-hdrext:ssrc-audio-level\\r\\n" +
 		"a=extmap:3 urn:ietf:params:rtp-hdrext:sdes:mid\\r\\n" +
 		"a=fmtp:109 maxplaybackrate=48000;stereo=1;useinbandfec=1\\r\\n" +
-		"a=ice-pwd:abcdefabcdefabcdefabcdefabcdefab\\r\\n" +
-		"a=ice-ufrag:fedcbafe\\r\\n" +
+		"a=ice-pwd:" + icePwd + "\\r\\n" +
+		"a=ice-ufrag:" + iceUfrag + "\\r\\n" +
 		"a=mid:sdparta_0\\r\\n" +
 		"a=rtcp-mux\\r\\n" +
 		"a=rtpmap:109 opus/48000/2\\r\\n" +
@@ -50,9 +58,11 @@ var (
 		"a=extmap:3 urn:ietf:params:rtp-hdrext:sdes:mid\\r\\n" +
 		"a=extmap:4 http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time\\r\\n" +
 		"a=extmap:5 urn:ietf:params:rtp-hdrext:toffset\\r\\n" +
+		"a=extmap:6 urn:ietf:params:rtp-hdrext:framemarking\\r\\n" +
+		"a=extmap:7 urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id\\r\\n" +
 		"a=fmtp:120 max-fs=12288;max-fr=60\\r\\n" +
-		"a=ice-pwd:abcdefabcdefabcdefabcdefabcdefab\\r\\n" +
-		"a=ice-ufrag:fedcbafe\\r\\n" +
+		"a=ice-pwd:" + icePwd + "\\r\\n" +
+		"a=ice-ufrag:" + iceUfrag + "\\r\\n" +
 		"a=mid:sdparta_1\\r\\n" +
 		"a=rtcp-fb:120 nack\\r\\n" +
 		"a=rtcp-fb:120 nack pli\\r\\n" +
@@ -60,7 +70,15 @@ var (
 		"a=rtcp-fb:120 goog-remb\\r\\n" +
 		"a=rtcp-mux\\r\\n" +
 		"a=rtpmap:120 VP8/90000\\r\\n" +
+		"a=rid:q recv\\r\\n" +
+		"a=rid:h recv\\r\\n" +
+		"a=rid:f recv\\r\\n" +
+		"a=simulcast:recv q;h;f\\r\\n" +
 		"a=setup:passive\\r\\n\"}")
+
+	// Audio slots for the active and previous speaker.  Both are
+	// delivered on the Opus PT from the offer above.
+	audioPTList = []int8{109, 109}
 )
 
 func panicOnError(err error) {
@@ -101,7 +119,120 @@ func localIP() string {
 
 var upgrader = websocket.Upgrader{} // use default options
 
-func httpServer() *http.Server {
+// Tell the MD about the header extension IDs in an SDP media section
+// a=extmap:<id>["/"<direction>] <URI> [<extension attributes>]
+func setExtensionIDs(md *percy.MDD, extmaps []string) {
+	for _, extmap := range extmaps {
+		fields := strings.Fields(extmap)
+		if len(fields) < 2 {
+			fmt.Println("Malformed extmap: ", extmap)
+			continue
+		}
+
+		idStr := strings.Split(fields[0], "/")[0]
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id < 1 || id > 255 {
+			fmt.Println("Malformed extmap ID: ", extmap)
+			continue
+		}
+
+		md.SetExtensionID(fields[1], uint8(id))
+	}
+}
+
+// Events about the conference go to the browser alongside the signaling
+// messages, as {"type": "event", "data": {...}}.  So that the browser can
+// tell itself apart, it is also told its own client ID, as
+// {"type": "client", "data": {"id": ...}}, once it has connected.
+type eventMessage struct {
+	Type string    `json:"type"`
+	Data eventData `json:"data"`
+}
+
+type eventData struct {
+	Event      string           `json:"event"`
+	Client     percy.ClientID   `json:"client,omitempty"`
+	Speakers   []percy.ClientID `json:"speakers,omitempty"`
+	AudioMuted bool             `json:"audioMuted,omitempty"`
+	VideoMuted bool             `json:"videoMuted,omitempty"`
+}
+
+func writeEvent(c *websocket.Conn, event percy.Event) error {
+	msg, err := json.Marshal(eventMessage{
+		Type: "event",
+		Data: eventData{
+			Event:      event.Type.String(),
+			Client:     event.ClientID,
+			Speakers:   event.Speakers,
+			AudioMuted: event.Mute.Audio(),
+			VideoMuted: event.Mute.Video(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.WriteMessage(websocket.TextMessage, msg)
+}
+
+type clientMessage struct {
+	Type string     `json:"type"`
+	Data clientData `json:"data"`
+}
+
+type clientData struct {
+	ID percy.ClientID `json:"id"`
+}
+
+func writeClientID(c *websocket.Conn, id percy.ClientID) error {
+	msg, err := json.Marshal(clientMessage{Type: "client", Data: clientData{ID: id}})
+	if err != nil {
+		return err
+	}
+
+	return c.WriteMessage(websocket.TextMessage, msg)
+}
+
+// Pass the SFU's events on to the browser, starting with who is speaking
+// now, until the subscription ends or the websocket fails.  Along the way,
+// tell the browser its client ID as soon as the registration it was
+// admitted with (from regs) has an association.  Nothing else writes to
+// the websocket once this has started.
+func forwardEvents(c *websocket.Conn, md *percy.MDD, speakers []percy.ClientID, events <-chan percy.Event, regs <-chan percy.ClientRegistration) {
+	var reg *percy.ClientRegistration
+	identified := false
+
+	err := writeEvent(c, percy.Event{Type: percy.EventSpeakers, ConfID: confID, Speakers: speakers})
+	for events != nil {
+		select {
+		case r := <-regs:
+			reg = &r
+
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if err == nil {
+				err = writeEvent(c, event)
+			}
+		}
+
+		if err != nil || identified || reg == nil {
+			continue
+		}
+		if id, ok := md.ClientID(*reg); ok {
+			err = writeClientID(c, id)
+			identified = true
+		}
+	}
+
+	if err != nil {
+		fmt.Println("write:", err)
+	}
+}
+
+func httpServer(md *percy.MDD) *http.Server {
 	// Read HTML file
 	file, err := os.Open(htmlFilename)
 	panicOnError(err)
@@ -160,6 +291,25 @@ func httpServer() *http.Server {
 			return
 		}
 
+		// Let the browser follow who is speaking.  Events stop if the
+		// conference goes away, so nothing waits on them after done.
+		regs := make(chan percy.ClientRegistration, 1)
+		done := make(chan struct{})
+		events := md.SFU.Subscribe(confID)
+		defer md.SFU.Unsubscribe(events)
+		go func() {
+			forwardEvents(c, md, md.SFU.ActiveSpeakers(confID), events, regs)
+			close(done)
+		}()
+
+		// The browser's credentials are only good while it is connected
+		var admitted []percy.ClientRegistration
+		defer func() {
+			for _, reg := range admitted {
+				md.RevokeClient(reg)
+			}
+		}()
+
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
@@ -201,6 +351,30 @@ func httpServer() *http.Server {
 			ice_ufrag := m.Medias[0].Attributes["ice-ufrag"][0]
 			fmt.Println("Media[0].ice-pwd: ", ice_pwd)
 			fmt.Println("Media[0].ice-ufrag: ", ice_ufrag)
+
+			for _, media := range m.Medias {
+				setExtensionIDs(md, media.Attributes["extmap"])
+			}
+
+			// Let the client's connectivity checks through
+			reg := percy.ClientRegistration{
+				LocalUfrag:  iceUfrag,
+				LocalPwd:    icePwd,
+				RemoteUfrag: ice_ufrag,
+				RemotePwd:   ice_pwd,
+				Conf:        confID,
+			}
+			err = md.AdmitClient(reg)
+			if err != nil {
+				fmt.Println("failed to admit client:", err)
+				break
+			}
+			admitted = append(admitted, reg)
+
+			select {
+			case regs <- reg:
+			case <-done:
+			}
 		}
 	})
 
@@ -214,8 +388,11 @@ func httpServer() *http.Server {
 //////////
 
 func main() {
-	// Process commandline (currently, just an optional port #)
+	// Process commandline (an optional port # and tunnel type)
 	args := os.Args
+	if len(args) >= 3 {
+		kdTunnel = args[2]
+	}
 	if len(args) >= 2 {
 		val, err := strconv.Atoi(args[1])
 		if err != nil {
@@ -226,23 +403,43 @@ func main() {
 		fmt.Printf("Setting port to non-default %d\n", port)
 	}
 
-	// Instantiate the interface to the KD
-	kd, err := percy.NewUDPForwarder(kdServer)
-	panicOnError(err)
-
 	// Instantiate the MD
 	md := percy.NewMDD()
+	md.SFU = percy.NewSFU(audioPTList)
+
+	// Instantiate the interface to the KD and wire the two together
+	switch kdTunnel {
+	case "udp":
+		kd, err := percy.NewUDPForwarder(kdServer)
+		panicOnError(err)
+		kd.MD = md
+		md.KD = kd
 
-	// Wire the two together
-	kd.MD = md
-	md.KD = kd
+	case "tls":
+		caPEM, err := ioutil.ReadFile(kdCAFilename)
+		panicOnError(err)
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEM) {
+			panic(fmt.Sprintf("No certificates found in '%s'", kdCAFilename))
+		}
+
+		kd, err := percy.NewTLSTunnel(kdServer, &tls.Config{RootCAs: roots})
+		panicOnError(err)
+		defer kd.Stop()
+		kd.MD = md
+		md.KD = kd
+
+	default:
+		panic(fmt.Sprintf("Unknown KD tunnel type '%s'", kdTunnel))
+	}
 
 	// Start up the MD
-	err = md.Listen(port)
+	err := md.Listen(port)
 	panicOnError(err)
 
 	// Start up the web server
-	srv := httpServer()
+	srv := httpServer(md)
 
 	fmt.Printf("Now connect to https://localhost:%d/ with a PERC web browser\n", port)
 	fmt.Println("Listening, press <enter> to stop")
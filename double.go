@@ -0,0 +1,425 @@
+package percy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// The MD's half of the PERC double transform.  A sender encrypts the
+// payload end-to-end, appends an Original Header Block (OHB), and then
+// encrypts the whole thing again with its hop-by-hop key:
+//
+//   header | HBH-Encrypt(E2E-Encrypt(payload) | OHB) | EKTField
+//
+// The MD removes the outer layer, may change the header (recording the
+// original values in the OHB), and re-applies the outer layer with each
+// receiver's key.  It never has the E2E key, and never modifies the inner
+// ciphertext.
+//
+// https://tools.ietf.org/html/rfc8723#section-5
+// https://tools.ietf.org/html/rfc7714#section-8
+
+const (
+	gcmTagLength    = 16
+	gcmSaltLength   = 12
+	gcmNonceLength  = 12
+	srtpWindowSize  = 0x8000
+	srtpReplaySize  = 64
+	srtpLabelKey    = 0x00
+	srtpLabelSalt   = 0x02
+	srtpMaxSaltSize = 14
+)
+
+// The SRTP key derivation function, with a key derivation rate of zero
+//
+// https://tools.ietf.org/html/rfc3711#section-4.3
+func srtpKDF(masterKey, masterSalt []byte, label byte, length int) ([]byte, error) {
+	if len(masterSalt) > srtpMaxSaltSize {
+		return nil, fmt.Errorf("SRTP master salt too long [%d]", len(masterSalt))
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// x = key_id XOR master_salt, where key_id is the label followed by a
+	// zero index.  The low 16 bits of the IV are the block counter.
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, masterSalt)
+	iv[7] ^= label
+
+	out := make([]byte, length)
+	cipher.NewCTR(block, iv).XORKeyStream(out, out)
+	return out, nil
+}
+
+// The replay list for a stream of packet indices: the highest index
+// received, and a bitmask of which of the ones before it have been.
+// Anything older than the window counts as a replay.
+//
+// https://tools.ietf.org/html/rfc3711#section-3.3.2
+type replayWindow struct {
+	started bool
+	latest  uint64
+	mask    uint64 // bit i is the packet i before the latest
+}
+
+func (w *replayWindow) replayed(index uint64) bool {
+	if !w.started || index > w.latest {
+		return false
+	}
+
+	delta := w.latest - index
+	return delta >= srtpReplaySize || w.mask&(1<<delta) != 0
+}
+
+// Note an authenticated packet as received
+func (w *replayWindow) accept(index uint64) {
+	switch {
+	case !w.started:
+		w.started = true
+		w.latest = index
+		w.mask = 1
+
+	case index > w.latest:
+		w.mask = w.mask<<(index-w.latest) | 1
+		w.latest = index
+
+	case w.latest-index < srtpReplaySize:
+		w.mask |= 1 << (w.latest - index)
+	}
+}
+
+// Tracks the rollover counter for one SSRC, and for packets received, the
+// replay list
+//
+// https://tools.ietf.org/html/rfc3711#section-3.3.1
+type srtpIndex struct {
+	started bool
+	roc     uint32
+	seq     uint16
+	replay  replayWindow
+}
+
+func (idx *srtpIndex) estimate(seq uint16) uint32 {
+	if !idx.started {
+		return 0
+	}
+
+	switch {
+	case idx.seq < srtpWindowSize && int(seq)-int(idx.seq) > srtpWindowSize:
+		if idx.roc == 0 {
+			return 0
+		}
+		return idx.roc - 1
+	case idx.seq >= srtpWindowSize && int(idx.seq)-srtpWindowSize > int(seq):
+		return idx.roc + 1
+	default:
+		return idx.roc
+	}
+}
+
+func (idx *srtpIndex) update(roc uint32, seq uint16) {
+	newer := roc > idx.roc || (roc == idx.roc && seq > idx.seq)
+	if !idx.started || newer {
+		idx.started = true
+		idx.roc = roc
+		idx.seq = seq
+	}
+}
+
+// An AES-GCM SRTP context for one direction of one association
+type srtpContext struct {
+	aead    cipher.AEAD
+	salt    []byte
+	indices map[uint32]*srtpIndex
+}
+
+func newSRTPContext(masterKey, masterSalt []byte) (*srtpContext, error) {
+	if len(masterKey) != 16 && len(masterKey) != 32 {
+		return nil, fmt.Errorf("Invalid SRTP master key length [%d]", len(masterKey))
+	}
+
+	if len(masterSalt) != gcmSaltLength {
+		return nil, fmt.Errorf("Invalid SRTP master salt length [%d]", len(masterSalt))
+	}
+
+	key, err := srtpKDF(masterKey, masterSalt, srtpLabelKey, len(masterKey))
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := srtpKDF(masterKey, masterSalt, srtpLabelSalt, gcmSaltLength)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &srtpContext{aead: aead, salt: salt, indices: map[uint32]*srtpIndex{}}, nil
+}
+
+func (ctx *srtpContext) index(ssrc uint32) *srtpIndex {
+	idx, ok := ctx.indices[ssrc]
+	if !ok {
+		idx = &srtpIndex{}
+		ctx.indices[ssrc] = idx
+	}
+	return idx
+}
+
+// IV = (0x0000 || SSRC || ROC || SEQ) XOR salt
+func (ctx *srtpContext) nonce(ssrc, roc uint32, seq uint16) []byte {
+	iv := make([]byte, gcmNonceLength)
+	iv[2] = byte(ssrc >> 24)
+	iv[3] = byte(ssrc >> 16)
+	iv[4] = byte(ssrc >> 8)
+	iv[5] = byte(ssrc)
+	iv[6] = byte(roc >> 24)
+	iv[7] = byte(roc >> 16)
+	iv[8] = byte(roc >> 8)
+	iv[9] = byte(roc)
+	iv[10] = byte(seq >> 8)
+	iv[11] = byte(seq)
+
+	for i := range iv {
+		iv[i] ^= ctx.salt[i]
+	}
+	return iv
+}
+
+// Encrypt a payload, authenticating the header along with it
+func (ctx *srtpContext) protect(header []byte, ssrc uint32, seq uint16, payload []byte) []byte {
+	idx := ctx.index(ssrc)
+	roc := idx.estimate(seq)
+	idx.update(roc, seq)
+
+	out := make([]byte, len(header), len(header)+len(payload)+gcmTagLength)
+	copy(out, header)
+	return ctx.aead.Seal(out, ctx.nonce(ssrc, roc, seq), payload, header)
+}
+
+// Decrypt and verify a packet, returning its payload
+func (ctx *srtpContext) unprotect(msg []byte, hdr *rtpHeader) ([]byte, error) {
+	if len(msg) < hdr.length+gcmTagLength {
+		return nil, fmt.Errorf("SRTP packet too short [%d]", len(msg))
+	}
+
+	idx := ctx.index(hdr.ssrc)
+	roc := idx.estimate(hdr.seq)
+	index := uint64(roc)<<16 | uint64(hdr.seq)
+	if idx.replay.replayed(index) {
+		return nil, fmt.Errorf("SRTP packet replayed")
+	}
+
+	header := msg[:hdr.length]
+	payload, err := ctx.aead.Open(nil, ctx.nonce(hdr.ssrc, roc, hdr.seq), msg[hdr.length:], header)
+	if err != nil {
+		return nil, fmt.Errorf("SRTP authentication failed")
+	}
+
+	idx.update(roc, hdr.seq)
+	idx.replay.accept(index)
+	return payload, nil
+}
+
+//////////
+
+// The Original Header Block carries the values of any header fields the
+// MD has changed, so that receivers can reconstruct the header the sender
+// authenticated in the inner layer.  It is always at least the config
+// byte, whose low bits (B, M, P, Q) say what follows:
+//
+//	OHB = [ PT ] [ SEQ ] Config
+//
+// https://tools.ietf.org/html/rfc8723#section-4
+const (
+	ohbFlagMarkerValue = 0x08 // B
+	ohbFlagMarker      = 0x04 // M
+	ohbFlagPT          = 0x02 // P
+	ohbFlagSeq         = 0x01 // Q
+	ohbFlagsReserved   = 0xf0
+)
+
+type ohb struct {
+	hasPT     bool
+	pt        uint8
+	hasSeq    bool
+	seq       uint16
+	hasMarker bool
+	marker    bool
+}
+
+// Split the plaintext of the outer layer into the inner ciphertext and the
+// OHB that trails it
+func splitOHB(plaintext []byte) ([]byte, ohb, error) {
+	var o ohb
+	if len(plaintext) < 1 {
+		return nil, o, fmt.Errorf("Missing OHB")
+	}
+
+	end := len(plaintext) - 1
+	config := plaintext[end]
+	if config&ohbFlagsReserved != 0 {
+		return nil, o, fmt.Errorf("Reserved OHB bits set [%02x]", config)
+	}
+
+	if config&ohbFlagSeq != 0 {
+		if end < 2 {
+			return nil, o, fmt.Errorf("OHB too short for SEQ")
+		}
+
+		o.hasSeq = true
+		o.seq = uint16(plaintext[end-2])<<8 | uint16(plaintext[end-1])
+		end -= 2
+	}
+
+	if config&ohbFlagPT != 0 {
+		if end < 1 {
+			return nil, o, fmt.Errorf("OHB too short for PT")
+		}
+
+		o.hasPT = true
+		o.pt = plaintext[end-1] & 0x7f
+		end -= 1
+	}
+
+	if config&ohbFlagMarker != 0 {
+		o.hasMarker = true
+		o.marker = config&ohbFlagMarkerValue != 0
+	}
+
+	return plaintext[:end], o, nil
+}
+
+func (o ohb) marshal() []byte {
+	var data []byte
+	var config byte
+
+	if o.hasPT {
+		data = append(data, o.pt&0x7f)
+		config |= ohbFlagPT
+	}
+
+	if o.hasSeq {
+		data = append(data, byte(o.seq>>8), byte(o.seq))
+		config |= ohbFlagSeq
+	}
+
+	if o.hasMarker {
+		config |= ohbFlagMarker
+		if o.marker {
+			config |= ohbFlagMarkerValue
+		}
+	}
+
+	return append(data, config)
+}
+
+//////////
+
+// An SRTP packet with the hop-by-hop layer removed.  The header may be
+// changed with the set* methods, which keep the OHB up to date; the inner
+// E2E ciphertext is opaque.
+type hbhPacket struct {
+	header []byte
+	hdr    *rtpHeader
+	inner  []byte
+	ohb    ohb
+}
+
+func (ctx *srtpContext) unprotectHBH(msg []byte) (*hbhPacket, error) {
+	hdr, err := parseRTPHeader(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := ctx.unprotect(msg, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	inner, o, err := splitOHB(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, hdr.length)
+	copy(header, msg)
+	return &hbhPacket{header: header, hdr: hdr, inner: inner, ohb: o}, nil
+}
+
+func (ctx *srtpContext) protectHBH(pkt *hbhPacket) []byte {
+	plaintext := make([]byte, 0, len(pkt.inner)+4)
+	plaintext = append(plaintext, pkt.inner...)
+	plaintext = append(plaintext, pkt.ohb.marshal()...)
+	return ctx.protect(pkt.header, pkt.hdr.ssrc, pkt.hdr.seq, plaintext)
+}
+
+// Copy a packet so that it can be changed for one receiver.  The inner
+// ciphertext is shared, since it is never modified.
+func (pkt *hbhPacket) clone() *hbhPacket {
+	hdr := *pkt.hdr
+	out := &hbhPacket{
+		header: make([]byte, len(pkt.header)),
+		hdr:    &hdr,
+		inner:  pkt.inner,
+		ohb:    pkt.ohb,
+	}
+	copy(out.header, pkt.header)
+	return out
+}
+
+// When the MD changes a field, the OHB records the sender's value, unless
+// it already does (i.e., an earlier hop changed it).  Changing a field
+// back to the sender's value removes it from the OHB.
+func (pkt *hbhPacket) setPT(pt uint8) {
+	orig := pkt.hdr.pt
+	if pkt.ohb.hasPT {
+		orig = pkt.ohb.pt
+	}
+
+	pkt.ohb.hasPT = pt != orig
+	pkt.ohb.pt = orig
+	pkt.hdr.pt = pt
+	pkt.header[1] = (pkt.header[1] & 0x80) | (pt & 0x7f)
+}
+
+func (pkt *hbhPacket) setSeq(seq uint16) {
+	orig := pkt.hdr.seq
+	if pkt.ohb.hasSeq {
+		orig = pkt.ohb.seq
+	}
+
+	pkt.ohb.hasSeq = seq != orig
+	pkt.ohb.seq = orig
+	pkt.hdr.seq = seq
+	pkt.header[2] = byte(seq >> 8)
+	pkt.header[3] = byte(seq)
+}
+
+func (pkt *hbhPacket) setMarker(marker bool) {
+	orig := pkt.hdr.marker
+	if pkt.ohb.hasMarker {
+		orig = pkt.ohb.marker
+	}
+
+	pkt.ohb.hasMarker = marker != orig
+	pkt.ohb.marker = orig
+	pkt.hdr.marker = marker
+	if marker {
+		pkt.header[1] |= 0x80
+	} else {
+		pkt.header[1] &^= 0x80
+	}
+}
@@ -0,0 +1,265 @@
+package percy
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+func unhex(h string) []byte {
+	data, err := hex.DecodeString(h)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+var (
+	e2eKey  = unhex("000102030405060708090a0b0c0d0e0f")
+	e2eSalt = unhex("a0a1a2a3a4a5a6a7a8a9aaab")
+	hbhKeyA = unhex("101112131415161718191a1b1c1d1e1f")
+	hbhSalA = unhex("b0b1b2b3b4b5b6b7b8b9babb")
+	hbhKeyB = unhex("202122232425262728292a2b2c2d2e2f")
+	hbhSalB = unhex("c0c1c2c3c4c5c6c7c8c9cacb")
+
+	doublePayload = []byte("PERC double payload")
+
+	// The packet the MD sends to the receiver in TestDoubleHop, with the PT
+	// changed from 109 to 110
+	doubleHopVector = "90ee0102030405060708090abede000210aa003161620000" +
+		"cc573187927b91752407f98ab43339a27b926938606fbbfb627274309484ce02" +
+		"1c5486d5cc8f0f6b85805ca3d1042dc24d6cc9b8fd00"
+)
+
+// https://tools.ietf.org/html/rfc3711#appendix-B.3
+func TestSRTPKDF(t *testing.T) {
+	masterKey := unhex("E1F97A0D3E018BE0D64FA32C06DE4139")
+	masterSalt := unhex("0EC675AD498AFEEBB6960B3AABE6")
+
+	key, err := srtpKDF(masterKey, masterSalt, srtpLabelKey, 16)
+	assert.NotError(t, err, "KDF failed")
+	assert.BytesEqual(t, key, unhex("C61E7A93744F39EE10734AFE3FF7A087"), "Wrong session key")
+
+	salt, err := srtpKDF(masterKey, masterSalt, srtpLabelSalt, 14)
+	assert.NotError(t, err, "KDF failed")
+	assert.BytesEqual(t, salt, unhex("30CBBC08863D8C85D49DB34A9AE1"), "Wrong session salt")
+}
+
+func TestSRTPIndex(t *testing.T) {
+	idx := &srtpIndex{}
+	assert.Equal(t, idx.estimate(0xfff0), uint32(0), "Wrong initial ROC")
+	idx.update(0, 0xfff0)
+
+	// Rollover, and a late packet from before it
+	assert.Equal(t, idx.estimate(0x0002), uint32(1), "Rollover not detected")
+	idx.update(1, 0x0002)
+	assert.Equal(t, idx.estimate(0xfffe), uint32(0), "Late packet assigned new ROC")
+	idx.update(0, 0xfffe)
+	assert.Equal(t, idx.roc, uint32(1), "Late packet moved ROC backward")
+}
+
+func TestReplayWindow(t *testing.T) {
+	w := &replayWindow{}
+	assert.True(t, !w.replayed(100), "First packet replayed")
+	w.accept(100)
+	assert.True(t, w.replayed(100), "Duplicate not detected")
+
+	// Late packets are fine once, within the window
+	w.accept(110)
+	assert.True(t, !w.replayed(105), "Late packet rejected")
+	w.accept(105)
+	assert.True(t, w.replayed(105), "Late duplicate not detected")
+	assert.True(t, w.replayed(110-srtpReplaySize), "Packet older than the window accepted")
+
+	// The window moves on with the latest packet
+	w.accept(110 + srtpReplaySize)
+	assert.True(t, w.replayed(110), "Duplicate not detected after a jump")
+	assert.True(t, !w.replayed(111), "Packet in the window rejected after a jump")
+}
+
+func TestSRTPReplay(t *testing.T) {
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	hdr, err := parseRTPHeader(header)
+	assert.NotError(t, err, "Bad test header")
+
+	send, _ := newSRTPContext(hbhKeyA, hbhSalA)
+	recv, _ := newSRTPContext(hbhKeyA, hbhSalA)
+	msg := send.protect(header, hdr.ssrc, hdr.seq, doublePayload)
+
+	_, err = recv.unprotect(msg, hdr)
+	assert.NotError(t, err, "Failed to decrypt SRTP")
+	_, err = recv.unprotect(msg, hdr)
+	assert.True(t, err != nil, "Replayed SRTP accepted")
+}
+
+// A sender's packet: header | HBH(E2E(payload) | OHB) | EKTField
+func doubleProtect(t *testing.T, header []byte, hbhKey, hbhSalt []byte) ([]byte, []byte) {
+	hdr, err := parseRTPHeader(header)
+	assert.NotError(t, err, "Bad test header")
+
+	e2e, err := newSRTPContext(e2eKey, e2eSalt)
+	assert.NotError(t, err, "Failed to create E2E context")
+	inner := e2e.protect(header, hdr.ssrc, hdr.seq, doublePayload)[len(header):]
+
+	hbh, err := newSRTPContext(hbhKey, hbhSalt)
+	assert.NotError(t, err, "Failed to create HBH context")
+	plaintext := append(append([]byte{}, inner...), ohb{}.marshal()...)
+	msg := hbh.protect(header, hdr.ssrc, hdr.seq, plaintext)
+	return append(msg, ektMsgTypeShort), inner
+}
+
+func TestDoubleHop(t *testing.T) {
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	msg, inner := doubleProtect(t, header, hbhKeyA, hbhSalA)
+
+	// MD: strip the EKT field and the sender's outer layer, change the PT,
+	// and protect for the receiver
+	srtp, field, err := splitEKTField(msg)
+	assert.NotError(t, err, "Failed to split EKT field")
+
+	mdRecv, _ := newSRTPContext(hbhKeyA, hbhSalA)
+	mdSend, _ := newSRTPContext(hbhKeyB, hbhSalB)
+
+	pkt, err := mdRecv.unprotectHBH(srtp)
+	assert.NotError(t, err, "MD failed to remove outer layer")
+	assert.BytesEqual(t, pkt.inner, inner, "Inner layer changed by outer decryption")
+
+	out := pkt.clone()
+	out.setPT(110)
+	fwd := append(mdSend.protectHBH(out), field.marshal()...)
+	assert.BytesEqual(t, fwd, unhex(doubleHopVector), "Wrong forwarded packet")
+
+	// The original packet is untouched by changes to the clone
+	assert.Equal(t, pkt.hdr.pt, uint8(109), "Clone shares header with original")
+
+	// Receiver: the inner ciphertext is byte-identical, and the OHB lets
+	// the receiver rebuild the header the sender authenticated
+	srtp, _, err = splitEKTField(fwd)
+	assert.NotError(t, err, "Failed to split EKT field")
+
+	rcvHBH, _ := newSRTPContext(hbhKeyB, hbhSalB)
+	rcv, err := rcvHBH.unprotectHBH(srtp)
+	assert.NotError(t, err, "Receiver failed to remove outer layer")
+	assert.BytesEqual(t, rcv.inner, inner, "Inner ciphertext changed across the hop")
+	assert.Equal(t, rcv.hdr.pt, uint8(110), "PT not rewritten")
+	assert.True(t, rcv.ohb.hasPT, "Original PT not in OHB")
+	assert.Equal(t, rcv.ohb.pt, uint8(109), "Wrong original PT in OHB")
+
+	origHeader, origHdr := originalHeader(rcv)
+	assert.BytesEqual(t, origHeader, header, "Original header not restored")
+
+	e2e, _ := newSRTPContext(e2eKey, e2eSalt)
+	payload, err := e2e.unprotect(append(origHeader, rcv.inner...), origHdr)
+	assert.NotError(t, err, "Inner layer failed to authenticate")
+	assert.BytesEqual(t, payload, doublePayload, "Wrong E2E payload")
+
+	// A packet from the wrong sender doesn't authenticate
+	_, err = mdSend.unprotectHBH(srtp[:len(srtp)-1])
+	assert.True(t, err != nil, "Truncated packet authenticated")
+	_, err = newSRTPContext(hbhKeyA, hbhSalA[:8])
+	assert.True(t, err != nil, "Accepted a short salt")
+}
+
+func TestOHB(t *testing.T) {
+	inner := []byte{0x01, 0x02, 0x03}
+	cases := []struct {
+		o    ohb
+		data []byte
+	}{
+		{ohb{}, []byte{0x00}},
+		{ohb{hasPT: true, pt: 109}, []byte{0x6d, 0x02}},
+		{ohb{hasSeq: true, seq: 0x1234}, []byte{0x12, 0x34, 0x01}},
+		{ohb{hasMarker: true, marker: true}, []byte{0x0c}},
+		{ohb{hasPT: true, pt: 96, hasSeq: true, seq: 0xfffe, hasMarker: true}, []byte{0x60, 0xff, 0xfe, 0x07}},
+	}
+
+	for _, c := range cases {
+		assert.BytesEqual(t, c.o.marshal(), c.data, "Wrong OHB encoding")
+
+		rest, o, err := splitOHB(append(append([]byte{}, inner...), c.data...))
+		assert.NotError(t, err, "Failed to parse OHB")
+		assert.BytesEqual(t, rest, inner, "Wrong inner ciphertext")
+		assert.Equal(t, o, c.o, "OHB did not round-trip")
+	}
+
+	_, _, err := splitOHB([]byte{})
+	assert.True(t, err != nil, "Parsed an empty OHB")
+	_, _, err = splitOHB([]byte{0x10})
+	assert.True(t, err != nil, "Parsed an OHB with reserved bits")
+	_, _, err = splitOHB([]byte{0x01, 0x01})
+	assert.True(t, err != nil, "Parsed a truncated OHB")
+
+	// Setting a field twice keeps the sender's value; setting it back
+	// removes it
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	hdr, _ := parseRTPHeader(header)
+	pkt := &hbhPacket{header: header, hdr: hdr}
+	pkt.setSeq(0x0500)
+	pkt.setSeq(0x0600)
+	pkt.setMarker(false)
+	assert.Equal(t, pkt.ohb, ohb{hasSeq: true, seq: 0x0102, hasMarker: true, marker: true}, "Wrong OHB after changes")
+	assert.Equal(t, header[1]&0x80, byte(0), "Marker not cleared")
+	assert.BytesEqual(t, header[2:4], []byte{0x06, 0x00}, "SEQ not rewritten")
+
+	pkt.setSeq(0x0102)
+	pkt.setMarker(true)
+	assert.True(t, !pkt.ohb.hasSeq && !pkt.ohb.hasMarker, "OHB not cleared")
+}
+
+// What a receiver does: rebuild the header the sender authenticated in
+// the inner layer from the OHB
+func originalHeader(pkt *hbhPacket) ([]byte, *rtpHeader) {
+	orig := pkt.clone()
+	if pkt.ohb.hasPT {
+		orig.setPT(pkt.ohb.pt)
+	}
+	if pkt.ohb.hasSeq {
+		orig.setSeq(pkt.ohb.seq)
+	}
+	if pkt.ohb.hasMarker {
+		orig.setMarker(pkt.ohb.marker)
+	}
+	return orig.header, orig.hdr
+}
+
+func TestRewriteAuthenticates(t *testing.T) {
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	header[1] &^= 0x80
+	msg, _ := doubleProtect(t, header, hbhKeyA, hbhSalA)
+	srtp, _, _ := splitEKTField(msg)
+
+	mdRecv, _ := newSRTPContext(hbhKeyA, hbhSalA)
+	mdSend, _ := newSRTPContext(hbhKeyB, hbhSalB)
+	pkt, err := mdRecv.unprotectHBH(srtp)
+	assert.NotError(t, err, "MD failed to remove outer layer")
+
+	// Slot 1 (PT 110) was carrying another sender, so this packet starts a
+	// new talkspurt there
+	client := &mddClient{slots: map[int]AssociationID{1: 7}}
+	src := mediaSource{assocID: 1, ssrc: pkt.hdr.ssrc}
+	out := client.rewrite(pkt, src, 1, Destination{clientID: 2, pt: 110, slot: 1})
+	assert.True(t, out != pkt, "Rewritten packet not copied")
+	assert.True(t, out.hdr.marker, "Marker not set on speaker switch")
+	assert.Equal(t, out.hdr.pt, uint8(110), "PT not rewritten")
+	assert.Equal(t, client.slots[1], AssociationID(1), "Slot not updated")
+
+	// Later packets from the same sender are left alone
+	again := client.rewrite(pkt, src, 2, Destination{clientID: 2, pt: 110, slot: 1})
+	assert.True(t, !again.hdr.marker, "Marker set without a switch")
+	assert.True(t, client.rewrite(pkt, src, 3, Destination{clientID: 2, pt: 109}) == pkt, "Unchanged packet copied")
+
+	// The receiver can still authenticate the inner layer
+	rcvHBH, _ := newSRTPContext(hbhKeyB, hbhSalB)
+	rcv, err := rcvHBH.unprotectHBH(mdSend.protectHBH(out))
+	assert.NotError(t, err, "Receiver failed to remove outer layer")
+	assert.True(t, rcv.ohb.hasMarker && !rcv.ohb.marker, "Original marker not in OHB")
+
+	origHeader, origHdr := originalHeader(rcv)
+	assert.BytesEqual(t, origHeader, header, "Original header not restored")
+
+	e2e, _ := newSRTPContext(e2eKey, e2eSalt)
+	payload, err := e2e.unprotect(append(origHeader, rcv.inner...), origHdr)
+	assert.NotError(t, err, "Inner layer failed to authenticate")
+	assert.BytesEqual(t, payload, doublePayload, "Wrong E2E payload")
+}
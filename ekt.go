@@ -0,0 +1,207 @@
+package percy
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Every PERC SRTP packet ends with an EKTField.  Most packets carry the
+// one-byte short form; the full form carries the sender's SRTP master key
+// encrypted under the conference-wide EKT key, which the MD never has.
+// The MD only needs to find the end of the SRTP packet, see which EKT key
+// (SPI) a sender is using, and pass the field along.
+//
+// https://tools.ietf.org/html/rfc8870#section-4.1
+const (
+	ektMsgTypeShort = 0x00
+	ektMsgTypeFull  = 0x02
+
+	ektShortLength   = 1
+	ektTrailerLength = 7 // SPI + Epoch + Length + Type
+)
+
+type ektField struct {
+	full       bool
+	spi        uint16
+	epoch      uint16
+	ciphertext []byte
+}
+
+var shortEKTField = &ektField{}
+
+// Split an SRTP packet into the packet proper and its EKTField
+func splitEKTField(msg []byte) ([]byte, *ektField, error) {
+	if len(msg) < ektShortLength {
+		return nil, nil, fmt.Errorf("Packet too short for EKT field")
+	}
+
+	switch msg[len(msg)-1] {
+	case ektMsgTypeShort:
+		return msg[:len(msg)-ektShortLength], shortEKTField, nil
+
+	case ektMsgTypeFull:
+		if len(msg) < ektTrailerLength {
+			return nil, nil, fmt.Errorf("Packet too short for full EKT field")
+		}
+
+		trailer := msg[len(msg)-ektTrailerLength:]
+		length := int(trailer[4])<<8 | int(trailer[5])
+		if length < ektTrailerLength || length > len(msg) {
+			return nil, nil, fmt.Errorf("Invalid full EKT field length [%d]", length)
+		}
+
+		start := len(msg) - length
+		field := &ektField{
+			full:       true,
+			spi:        uint16(trailer[0])<<8 | uint16(trailer[1]),
+			epoch:      uint16(trailer[2])<<8 | uint16(trailer[3]),
+			ciphertext: msg[start : len(msg)-ektTrailerLength],
+		}
+		return msg[:start], field, nil
+
+	default:
+		return nil, nil, fmt.Errorf("Unknown EKT message type [%02x]", msg[len(msg)-1])
+	}
+}
+
+func (field *ektField) marshal() []byte {
+	if !field.full {
+		return []byte{ektMsgTypeShort}
+	}
+
+	length := len(field.ciphertext) + ektTrailerLength
+	data := make([]byte, length)
+	copy(data, field.ciphertext)
+
+	trailer := data[len(field.ciphertext):]
+	trailer[0] = byte(field.spi >> 8)
+	trailer[1] = byte(field.spi)
+	trailer[2] = byte(field.epoch >> 8)
+	trailer[3] = byte(field.epoch)
+	trailer[4] = byte(length >> 8)
+	trailer[5] = byte(length)
+	trailer[6] = ektMsgTypeFull
+	return data
+}
+
+func (field *ektField) equal(other *ektField) bool {
+	if field == nil || other == nil {
+		return field == other
+	}
+
+	return field.full == other.full &&
+		field.spi == other.spi &&
+		field.epoch == other.epoch &&
+		bytes.Equal(field.ciphertext, other.ciphertext)
+}
+
+//////////
+
+// A media source, as seen by the MD
+type mediaSource struct {
+	assocID AssociationID
+	ssrc    uint32
+}
+
+// EKT state for an MD.  A sender announces a new SRTP master key with full
+// EKT fields; the MD remembers the latest one for each source, so that a
+// receiver that hasn't seen it yet (e.g., one that joined late, or that
+// just started receiving this source from the SFU) gets the full field
+// instead of a short one and can decrypt the inner layer.
+//
+// SPIs identify EKT keys, and so belong to a single conference.  A full
+// field whose SPI is in use by another conference is refused, since the
+// sender can't legitimately have that conference's EKT key.
+type ektState struct {
+	spis      map[uint16]ConfID
+	fields    map[mediaSource]*ektField
+	delivered map[AssociationID]map[mediaSource]*ektField
+}
+
+func newEKTState() *ektState {
+	return &ektState{
+		spis:      map[uint16]ConfID{},
+		fields:    map[mediaSource]*ektField{},
+		delivered: map[AssociationID]map[mediaSource]*ektField{},
+	}
+}
+
+// Process the EKT field on a packet from a source in the given conference
+func (ekt *ektState) receive(confID ConfID, src mediaSource, field *ektField) error {
+	if !field.full {
+		return nil
+	}
+
+	owner, ok := ekt.spis[field.spi]
+	if ok && owner != confID {
+		return fmt.Errorf("EKT SPI [%04x] belongs to another conference", field.spi)
+	}
+
+	ekt.spis[field.spi] = confID
+	ekt.fields[src] = field
+	return nil
+}
+
+// The EKT field to send to a receiver along with a packet from a source
+func (ekt *ektState) forward(receiver AssociationID, src mediaSource, field *ektField) *ektField {
+	latest, ok := ekt.fields[src]
+	if !ok {
+		return field
+	}
+
+	delivered, ok := ekt.delivered[receiver]
+	if !ok {
+		delivered = map[mediaSource]*ektField{}
+		ekt.delivered[receiver] = delivered
+	}
+
+	if field.full {
+		delivered[src] = field
+		return field
+	}
+
+	if !latest.equal(delivered[src]) {
+		delivered[src] = latest
+		return latest
+	}
+
+	return field
+}
+
+// The SPIs currently in use in a conference, in no particular order
+func (ekt *ektState) confSPIs(confID ConfID) []uint16 {
+	spis := []uint16{}
+	for spi, owner := range ekt.spis {
+		if owner == confID {
+			spis = append(spis, spi)
+		}
+	}
+	return spis
+}
+
+// Forget everything about an association, both as a source and as a
+// receiver
+func (ekt *ektState) remove(assocID AssociationID) {
+	delete(ekt.delivered, assocID)
+	for src := range ekt.fields {
+		if src.assocID == assocID {
+			delete(ekt.fields, src)
+		}
+	}
+	for _, delivered := range ekt.delivered {
+		for src := range delivered {
+			if src.assocID == assocID {
+				delete(delivered, src)
+			}
+		}
+	}
+}
+
+// Release a conference's SPIs once it has no members left
+func (ekt *ektState) removeConf(confID ConfID) {
+	for spi, owner := range ekt.spis {
+		if owner == confID {
+			delete(ekt.spis, spi)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package percy
+
+import (
+	"testing"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+var (
+	srtpBody = []byte{0x80, 0x6d, 0x00, 0x01, 0xa0, 0xa1, 0xa2, 0xa3}
+
+	// Ciphertext c0c1c2, SPI=0x1234, Epoch=0x0005, Length=10
+	fullEKTField = []byte{0xc0, 0xc1, 0xc2, 0x12, 0x34, 0x00, 0x05, 0x00, 0x0a, 0x02}
+)
+
+func TestSplitEKTField(t *testing.T) {
+	msg := append(append([]byte{}, srtpBody...), ektMsgTypeShort)
+	srtp, field, err := splitEKTField(msg)
+	assert.NotError(t, err, "Failed to split short EKT field")
+	assert.BytesEqual(t, srtp, srtpBody, "Wrong SRTP packet")
+	assert.True(t, !field.full, "Short EKT field parsed as full")
+	assert.BytesEqual(t, field.marshal(), []byte{ektMsgTypeShort}, "Wrong short EKT field")
+
+	msg = append(append([]byte{}, srtpBody...), fullEKTField...)
+	srtp, field, err = splitEKTField(msg)
+	assert.NotError(t, err, "Failed to split full EKT field")
+	assert.BytesEqual(t, srtp, srtpBody, "Wrong SRTP packet")
+	assert.True(t, field.full, "Full EKT field parsed as short")
+	assert.Equal(t, field.spi, uint16(0x1234), "Wrong SPI")
+	assert.Equal(t, field.epoch, uint16(0x0005), "Wrong epoch")
+	assert.BytesEqual(t, field.ciphertext, fullEKTField[:3], "Wrong EKT ciphertext")
+	assert.BytesEqual(t, field.marshal(), fullEKTField, "Full EKT field did not round-trip")
+
+	// No EKT field, bad lengths
+	_, _, err = splitEKTField(srtpBody)
+	assert.True(t, err != nil, "Split a packet with no EKT field")
+	_, _, err = splitEKTField(fullEKTField[4:])
+	assert.True(t, err != nil, "Split a truncated full EKT field")
+	bad := append(append([]byte{}, srtpBody...), 0x12, 0x34, 0x00, 0x05, 0x01, 0x00, 0x02)
+	_, _, err = splitEKTField(bad)
+	assert.True(t, err != nil, "Split a full EKT field longer than the packet")
+}
+
+func TestEKTState(t *testing.T) {
+	ekt := newEKTState()
+	src := mediaSource{assocID: 1, ssrc: 0x01020304}
+	_, full, _ := splitEKTField(fullEKTField)
+
+	// Short fields pass through until the source sends a full one
+	err := ekt.receive(1, src, shortEKTField)
+	assert.NotError(t, err, "Refused a short EKT field")
+	assert.True(t, !ekt.forward(2, src, shortEKTField).full, "Full field sent before one was seen")
+
+	err = ekt.receive(1, src, full)
+	assert.NotError(t, err, "Refused a full EKT field")
+	assert.True(t, ekt.forward(2, src, full).full, "Full field not forwarded")
+	spis := ekt.confSPIs(1)
+	assert.Equal(t, len(spis), 1, "Wrong number of SPIs for conference")
+	assert.Equal(t, spis[0], uint16(0x1234), "SPI not tracked for conference")
+
+	// A receiver that has the sender's key gets short fields; one that
+	// doesn't gets the full field once
+	assert.True(t, !ekt.forward(2, src, shortEKTField).full, "Full field repeated")
+	assert.True(t, ekt.forward(3, src, shortEKTField).full, "Late joiner did not get full field")
+	assert.True(t, !ekt.forward(3, src, shortEKTField).full, "Full field repeated to late joiner")
+
+	// Key rotation by the sender is passed on to everyone
+	rotated := *full
+	rotated.epoch += 1
+	ekt.receive(1, src, &rotated)
+	ekt.forward(2, src, &rotated)
+	assert.True(t, !ekt.forward(2, src, shortEKTField).full, "Rotated field repeated")
+	assert.Equal(t, ekt.forward(3, src, shortEKTField).epoch, rotated.epoch, "Rotated key not delivered")
+
+	// SPIs are confined to a conference
+	other := mediaSource{assocID: 4, ssrc: 0x0a0b0c0d}
+	err = ekt.receive(2, other, full)
+	assert.True(t, err != nil, "Accepted an SPI from another conference")
+
+	ekt.remove(src.assocID)
+	assert.True(t, !ekt.forward(3, src, shortEKTField).full, "Removed source still tracked")
+
+	ekt.removeConf(1)
+	assert.Equal(t, len(ekt.confSPIs(1)), 0, "Conference SPIs not released")
+	err = ekt.receive(2, other, full)
+	assert.NotError(t, err, "Released SPI not reusable")
+}
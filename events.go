@@ -0,0 +1,88 @@
+package percy
+
+import "fmt"
+
+// Events from the SFU about what is happening in a conference, for
+// applications that want to follow along (e.g., to highlight the active
+// speaker, or show who is muted).
+// Each subscriber gets its own buffered channel; the SFU never blocks on a
+// subscriber, so one that falls behind by more than eventQueueSize events
+// misses the rest.
+
+const eventQueueSize = 64
+
+type EventType int
+
+const (
+	EventMute     EventType = iota // a client's mute state changed
+	EventJoin                      // a client joined the conference
+	EventLeave                     // a client left the conference
+	EventSpeakers                  // the speakers changed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventMute:
+		return "mute"
+	case EventJoin:
+		return "join"
+	case EventLeave:
+		return "leave"
+	case EventSpeakers:
+		return "speakers"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+type Event struct {
+	Type     EventType
+	ConfID   ConfID
+	ClientID ClientID   // for everything but EventSpeakers
+	Mute     MuteState  // for EventMute
+	Speakers []ClientID // for EventSpeakers, as from ActiveSpeakers
+}
+
+// get events for a conference, until Unsubscribe or the conference is
+// destroyed, when the channel is closed
+func (sfu *SFU) Subscribe(confID ConfID) <-chan Event {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	ch := make(chan Event, eventQueueSize)
+	sfu.subscribers[confID] = append(sfu.subscribers[confID], ch)
+	return ch
+}
+
+// stop getting events on a channel from Subscribe, and close it
+func (sfu *SFU) Unsubscribe(events <-chan Event) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	for confID, subs := range sfu.subscribers {
+		for i, ch := range subs {
+			if (<-chan Event)(ch) != events {
+				continue
+			}
+
+			close(ch)
+			subs = append(subs[:i], subs[i+1:]...)
+			if len(subs) == 0 {
+				delete(sfu.subscribers, confID)
+			} else {
+				sfu.subscribers[confID] = subs
+			}
+			return
+		}
+	}
+}
+
+// send an event to everyone following its conference.  Expects the lock
+// to be held.
+func (sfu *SFU) emit(event Event) {
+	for _, ch := range sfu.subscribers[event.ConfID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package percy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+// the next event of a type, skipping any others
+func nextEvent(t *testing.T, events <-chan Event, eventType EventType) Event {
+	for {
+		select {
+		case event, ok := <-events:
+			assert.True(t, ok, "Events closed")
+			if event.Type == eventType {
+				return event
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No %v event", eventType)
+		}
+	}
+}
+
+func TestSFUEvents(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+	err := sfu.CreateConf(1, ConfOptions{})
+	assert.NotError(t, err, "Failed to create conference")
+
+	events := sfu.Subscribe(1)
+	other := sfu.Subscribe(2)
+
+	sfu.AddClient(1, 1)
+	event := <-events
+	assert.Equal(t, event.Type, EventJoin, "Wrong event for join")
+	assert.Equal(t, event.ClientID, ClientID(1), "Wrong client joined")
+
+	sfu.AddClient(1, 2)
+	sfu.UpdateEnergy(1, -10, true)
+	event = nextEvent(t, events, EventSpeakers)
+	assertClientIDs(t, event.Speakers, []ClientID{1, 0}, "Wrong speakers in event")
+
+	// The event has its own copy of the speakers
+	sfu.UpdateEnergy(2, -20, true)
+	assertClientIDs(t, event.Speakers, []ClientID{1, 0}, "Speakers in event changed")
+	event = nextEvent(t, events, EventSpeakers)
+	assertClientIDs(t, event.Speakers, []ClientID{1, 2}, "Wrong speakers in event")
+
+	sfu.RemoveClient(1, 1)
+	event = nextEvent(t, events, EventLeave)
+	assert.Equal(t, event.ClientID, ClientID(1), "Wrong client left")
+	event = nextEvent(t, events, EventSpeakers)
+	assertClientIDs(t, event.Speakers, []ClientID{2, 0}, "Wrong speakers after leave")
+
+	// Nothing for other conferences
+	select {
+	case event := <-other:
+		t.Fatalf("Event for another conference: %v", event.Type)
+	default:
+	}
+
+	// Destroying the conference ends its events
+	sfu.DestroyConf(1)
+	nextEvent(t, events, EventLeave)
+	for range events {
+	}
+
+	sfu.Unsubscribe(other)
+	_, ok := <-other
+	assert.True(t, !ok, "Events not closed by Unsubscribe")
+}
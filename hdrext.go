@@ -0,0 +1,207 @@
+package percy
+
+import (
+	"fmt"
+)
+
+// Header extension URIs the MD knows how to interpret
+const (
+	ExtensionAudioLevel   = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+	ExtensionFrameMarking = "urn:ietf:params:rtp-hdrext:framemarking"
+	ExtensionRID          = "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"
+	ExtensionMID          = "urn:ietf:params:rtp-hdrext:sdes:mid"
+)
+
+const (
+	rtpHeaderSize         = 12
+	extProfileOneByte     = 0xBEDE
+	extProfileTwoByte     = 0x1000
+	extProfileTwoByteMask = 0xFFF0
+)
+
+// The parts of an RTP header that the MD is allowed to see.  In SRTP the
+// header (including extensions) is sent in the clear, so this can be read
+// directly off the wire.
+//
+// https://tools.ietf.org/html/rfc3550#section-5.1
+type rtpHeader struct {
+	marker     bool
+	pt         uint8
+	seq        uint16
+	timestamp  uint32
+	ssrc       uint32
+	csrcs      []uint32
+	extProfile uint16
+	extensions map[uint8][]byte
+	length     int
+}
+
+func parseRTPHeader(msg []byte) (*rtpHeader, error) {
+	if len(msg) < rtpHeaderSize {
+		return nil, fmt.Errorf("RTP packet too short [%d]", len(msg))
+	}
+
+	if msg[0]>>6 != 2 {
+		return nil, fmt.Errorf("Unsupported RTP version [%d]", msg[0]>>6)
+	}
+
+	hdr := &rtpHeader{
+		marker:    msg[1]&0x80 != 0,
+		pt:        msg[1] & 0x7f,
+		seq:       uint16(msg[2])<<8 | uint16(msg[3]),
+		timestamp: readUint32(msg[4:]),
+		ssrc:      readUint32(msg[8:]),
+	}
+
+	cc := int(msg[0] & 0x0f)
+	hdr.length = rtpHeaderSize + 4*cc
+	if len(msg) < hdr.length {
+		return nil, fmt.Errorf("RTP packet too short for CSRC list")
+	}
+
+	for i := 0; i < cc; i++ {
+		hdr.csrcs = append(hdr.csrcs, readUint32(msg[rtpHeaderSize+4*i:]))
+	}
+
+	// No header extension
+	if msg[0]&0x10 == 0 {
+		return hdr, nil
+	}
+
+	// https://tools.ietf.org/html/rfc3550#section-5.3.1
+	if len(msg) < hdr.length+4 {
+		return nil, fmt.Errorf("RTP packet too short for header extension")
+	}
+
+	ext := msg[hdr.length:]
+	hdr.extProfile = uint16(ext[0])<<8 | uint16(ext[1])
+	extLen := 4 * (int(ext[2])<<8 | int(ext[3]))
+	hdr.length += 4 + extLen
+	if len(msg) < hdr.length {
+		return nil, fmt.Errorf("RTP header extension overruns packet")
+	}
+
+	var err error
+	switch {
+	case hdr.extProfile == extProfileOneByte:
+		hdr.extensions, err = parseOneByteExtensions(ext[4 : 4+extLen])
+	case hdr.extProfile&extProfileTwoByteMask == extProfileTwoByte:
+		hdr.extensions, err = parseTwoByteExtensions(ext[4 : 4+extLen])
+	default:
+		// Some other header extension we don't understand
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return hdr, nil
+}
+
+// https://tools.ietf.org/html/rfc8285#section-4.2
+func parseOneByteExtensions(data []byte) (map[uint8][]byte, error) {
+	extensions := map[uint8][]byte{}
+	for len(data) > 0 {
+		id := data[0] >> 4
+		length := int(data[0]&0x0f) + 1
+
+		switch id {
+		case 0:
+			// Padding
+			data = data[1:]
+			continue
+		case 15:
+			// Reserved; stop processing
+			return extensions, nil
+		}
+
+		if len(data) < 1+length {
+			return nil, fmt.Errorf("One-byte header extension [%d] overruns header", id)
+		}
+
+		extensions[id] = data[1 : 1+length]
+		data = data[1+length:]
+	}
+
+	return extensions, nil
+}
+
+// https://tools.ietf.org/html/rfc8285#section-4.3
+func parseTwoByteExtensions(data []byte) (map[uint8][]byte, error) {
+	extensions := map[uint8][]byte{}
+	for len(data) > 0 {
+		id := data[0]
+		if id == 0 {
+			// Padding
+			data = data[1:]
+			continue
+		}
+
+		if len(data) < 2 {
+			return nil, fmt.Errorf("Two-byte header extension [%d] truncated", id)
+		}
+
+		length := int(data[1])
+		if len(data) < 2+length {
+			return nil, fmt.Errorf("Two-byte header extension [%d] overruns header", id)
+		}
+
+		extensions[id] = data[2 : 2+length]
+		data = data[2+length:]
+	}
+
+	return extensions, nil
+}
+
+// Returns the audio level in dBov (0 to -127) and the voice activity flag
+//
+// https://tools.ietf.org/html/rfc6464#section-3
+func parseAudioLevel(data []byte) (int8, bool, error) {
+	if len(data) < 1 {
+		return 0, false, fmt.Errorf("Empty audio level extension")
+	}
+
+	vad := data[0]&0x80 != 0
+	level := -int8(data[0] & 0x7f)
+	return level, vad, nil
+}
+
+// Frame marking describes the video frame a packet belongs to, so that the
+// MD can find keyframes and layers without seeing the (encrypted) payload.
+// The short form is for non-scalable streams; the long form adds the
+// layer ID and TL0PICIDX, which the MD doesn't need.
+//
+//	S E I D B TID
+//
+// https://tools.ietf.org/html/rfc9626#section-3
+type frameMarking struct {
+	start       bool // first packet of a frame
+	end         bool // last packet of a frame
+	independent bool // frame can be decoded on its own (a keyframe)
+	discardable bool // no other frame depends on this one
+	baseSync    bool // only depends on the base temporal layer
+	tid         uint8
+}
+
+func parseFrameMarking(data []byte) (frameMarking, error) {
+	if len(data) < 1 {
+		return frameMarking{}, fmt.Errorf("Empty frame marking extension")
+	}
+
+	return frameMarking{
+		start:       data[0]&0x80 != 0,
+		end:         data[0]&0x40 != 0,
+		independent: data[0]&0x20 != 0,
+		discardable: data[0]&0x10 != 0,
+		baseSync:    data[0]&0x08 != 0,
+		tid:         data[0] & 0x07,
+	}, nil
+}
+
+// Whether this is the first packet of a keyframe
+func (fm frameMarking) keyframe() bool {
+	return fm.start && fm.independent
+}
+
+func readUint32(data []byte) uint32 {
+	return uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+}
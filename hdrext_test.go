@@ -0,0 +1,95 @@
+package percy
+
+import (
+	"testing"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+var (
+	// V=2, X=1, M=1, PT=109, SEQ=0x0102, TS=0x03040506, SSRC=0x0708090a
+	rtpHeaderBase = []byte{0x90, 0xed, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a}
+
+	// One-byte form: ID=1 audio level (VAD, -42 dBov), padding, ID=3 (two bytes)
+	oneByteExtension = []byte{
+		0xbe, 0xde, 0x00, 0x02,
+		0x10, 0xaa, 0x00, 0x31,
+		0x61, 0x62, 0x00, 0x00,
+	}
+
+	// Two-byte form: ID=1 audio level (no VAD, -10 dBov), ID=20 (zero length)
+	twoByteExtension = []byte{
+		0x10, 0x00, 0x00, 0x02,
+		0x01, 0x01, 0x0a, 0x00,
+		0x14, 0x00, 0x00, 0x00,
+	}
+)
+
+func TestParseRTPHeaderOneByte(t *testing.T) {
+	msg := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	msg = append(msg, 0xff, 0xff)
+
+	hdr, err := parseRTPHeader(msg)
+	assert.NotError(t, err, "Failed to parse RTP header")
+	assert.True(t, hdr.marker, "Marker bit not parsed")
+	assert.Equal(t, hdr.pt, uint8(109), "Wrong PT")
+	assert.Equal(t, hdr.seq, uint16(0x0102), "Wrong sequence number")
+	assert.Equal(t, hdr.timestamp, uint32(0x03040506), "Wrong timestamp")
+	assert.Equal(t, hdr.ssrc, uint32(0x0708090a), "Wrong SSRC")
+	assert.Equal(t, hdr.length, len(msg)-2, "Wrong header length")
+	assert.Equal(t, len(hdr.extensions), 2, "Wrong number of extensions")
+	assert.BytesEqual(t, hdr.extensions[3], []byte{0x61, 0x62}, "Wrong extension value")
+
+	level, vad, err := parseAudioLevel(hdr.extensions[1])
+	assert.NotError(t, err, "Failed to parse audio level")
+	assert.Equal(t, level, int8(-42), "Wrong audio level")
+	assert.True(t, vad, "VAD bit not parsed")
+}
+
+func TestParseRTPHeaderTwoByte(t *testing.T) {
+	msg := append(append([]byte{}, rtpHeaderBase...), twoByteExtension...)
+
+	hdr, err := parseRTPHeader(msg)
+	assert.NotError(t, err, "Failed to parse RTP header")
+	assert.Equal(t, len(hdr.extensions), 2, "Wrong number of extensions")
+	assert.Equal(t, len(hdr.extensions[20]), 0, "Wrong extension length")
+
+	level, vad, err := parseAudioLevel(hdr.extensions[1])
+	assert.NotError(t, err, "Failed to parse audio level")
+	assert.Equal(t, level, int8(-10), "Wrong audio level")
+	assert.True(t, !vad, "VAD bit set")
+}
+
+func TestParseRTPHeaderErrors(t *testing.T) {
+	_, err := parseRTPHeader(rtpHeaderBase[:8])
+	assert.True(t, err != nil, "Parsed truncated header")
+
+	// Extension length runs past the end of the packet
+	msg := append(append([]byte{}, rtpHeaderBase...), oneByteExtension[:8]...)
+	_, err = parseRTPHeader(msg)
+	assert.True(t, err != nil, "Parsed truncated extension block")
+
+	// Element length runs past the end of the extension block
+	msg = append(append([]byte{}, rtpHeaderBase...), 0xbe, 0xde, 0x00, 0x01, 0x13, 0x00, 0x00, 0x00)
+	_, err = parseRTPHeader(msg)
+	assert.True(t, err != nil, "Parsed overlong extension element")
+}
+
+func TestParseFrameMarking(t *testing.T) {
+	// Start of a keyframe, long form (LID=1, TL0PICIDX=2)
+	fm, err := parseFrameMarking([]byte{0xa0, 0x01, 0x02})
+	assert.NotError(t, err, "Failed to parse frame marking")
+	assert.True(t, fm.start && fm.independent, "Keyframe not recognized")
+	assert.True(t, !fm.end && !fm.discardable && !fm.baseSync, "Wrong flags")
+	assert.Equal(t, fm.tid, uint8(0), "Wrong TID")
+
+	// End of a discardable frame in temporal layer 2
+	fm, err = parseFrameMarking([]byte{0x5a})
+	assert.NotError(t, err, "Failed to parse frame marking")
+	assert.True(t, fm.end && fm.discardable && fm.baseSync, "Wrong flags")
+	assert.True(t, !fm.start && !fm.independent, "Wrong flags")
+	assert.Equal(t, fm.tid, uint8(2), "Wrong TID")
+
+	_, err = parseFrameMarking([]byte{})
+	assert.True(t, err != nil, "Parsed empty frame marking")
+}
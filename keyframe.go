@@ -0,0 +1,86 @@
+package percy
+
+import (
+	"log"
+	"time"
+)
+
+// When the SFU switches a receiver's video to a new source, or the MD
+// switches it to a new simulcast layer, the receiver starts getting the new
+// stream in the middle of a group of pictures, and can't decode anything
+// until the next keyframe.  So the MD asks the new source for a
+// keyframe (PLI), and holds the source's video back from the receiver
+// until one arrives.
+//
+// The MD can't see inside the payload, so it relies on frame marking to
+// find keyframes.  Without it, the MD still asks for a keyframe but can't
+// hold anything back.  Requests are rate-limited per source, since a
+// switch affects every receiver at once, and are repeated while anyone is
+// still waiting in case the keyframe was lost.
+//
+// https://tools.ietf.org/html/rfc4585#section-6.3.1
+
+const defaultKeyframeInterval = 500 * time.Millisecond
+
+// Whether this client has to wait for a keyframe before it gets video from
+// a source.  That is the case unless it is already decoding the source,
+// having got it from a keyframe on without a break.  A source moving
+// between the client's views is the same stream, so it doesn't need one.
+func (client *mddClient) awaitingKeyframe(src mediaSource, dest Destination) bool {
+	if dest.pt != 0 {
+		return false
+	}
+
+	if client.decoding == nil {
+		client.decoding = map[mediaSource]bool{}
+	}
+	return !client.decoding[src]
+}
+
+// Note that the clients not getting a video source any more have stopped
+// decoding it, so they need a keyframe if they get it again.  Only clients
+// that got the last packet can be decoding the source.
+func (mdd *MDD) stopDecoding(src mediaSource, getting map[AssociationID]bool) {
+	for assocID := range mdd.videoReceivers[src] {
+		if client, ok := mdd.clients[assocID]; ok && !getting[assocID] {
+			delete(client.decoding, src)
+		}
+	}
+	mdd.videoReceivers[src] = getting
+}
+
+// The frame marking on a packet, if it has any
+func (mdd *MDD) frameMarking(hdr *rtpHeader) (frameMarking, bool) {
+	id, ok := mdd.extensions[ExtensionFrameMarking]
+	if !ok {
+		return frameMarking{}, false
+	}
+
+	ext, ok := hdr.extensions[id]
+	if !ok {
+		return frameMarking{}, false
+	}
+
+	fm, err := parseFrameMarking(ext)
+	if err != nil {
+		log.Printf("Error parsing frame marking: %v", err)
+		return frameMarking{}, false
+	}
+
+	return fm, true
+}
+
+// Ask a source for a keyframe, unless it was asked recently.  Returns true
+// if a request was sent.
+func (mdd *MDD) requestKeyframe(src mediaSource, now time.Time) bool {
+	if last, ok := mdd.keyframeRequests[src]; ok && now.Sub(last) < mdd.keyframeInterval {
+		return false
+	}
+	mdd.keyframeRequests[src] = now
+
+	pli := newRTCPPacket(rtcpFmtPLI, rtcpTypePSFB, make([]byte, rtcpFeedbackSize))
+	putUint32(pli[4:], mdd.ssrc)
+	putUint32(pli[8:], src.ssrc)
+	mdd.sendRTCP(src.assocID, []rtcpPacket{pli})
+	return true
+}
@@ -0,0 +1,41 @@
+package percy
+
+import (
+	"testing"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+func TestAwaitingKeyframe(t *testing.T) {
+	mdd := NewMDD()
+	client := &mddClient{}
+	mdd.clients[3] = client
+
+	srcA := mediaSource{assocID: 1, ssrc: 0x0a}
+	srcB := mediaSource{assocID: 2, ssrc: 0x0b}
+	main := Destination{clientID: 3, pt: 0}
+	thumbnail := Destination{clientID: 3, pt: 0, view: 1}
+
+	// Audio never waits; a new video source does
+	assert.True(t, !client.awaitingKeyframe(srcA, Destination{clientID: 3, pt: 109}), "Audio waiting for a keyframe")
+	assert.True(t, client.awaitingKeyframe(srcA, thumbnail), "New source not waiting for a keyframe")
+	client.decoding[srcA] = true
+
+	// Moving between views is the same stream
+	assert.True(t, !client.awaitingKeyframe(srcA, main), "Waiting for a keyframe after moving views")
+	assert.True(t, client.awaitingKeyframe(srcB, thumbnail), "Other source not waiting for a keyframe")
+
+	// A client that stops getting a source needs a keyframe to start again
+	mdd.stopDecoding(srcA, map[AssociationID]bool{3: true})
+	assert.True(t, !client.awaitingKeyframe(srcA, main), "Waiting for a keyframe while still getting the source")
+	mdd.stopDecoding(srcA, map[AssociationID]bool{})
+	assert.True(t, client.awaitingKeyframe(srcA, main), "Not waiting for a keyframe after a break")
+
+	// Only the clients that got the last packet are checked, not everyone
+	// the MD serves
+	other := &mddClient{decoding: map[mediaSource]bool{srcB: true}}
+	mdd.clients[4] = other
+	mdd.stopDecoding(srcB, map[AssociationID]bool{})
+	assert.True(t, other.decoding[srcB], "Client that wasn't getting the source checked")
+	assert.Equal(t, len(mdd.videoReceivers[srcB]), 0, "Receivers not recorded")
+}
@@ -1,10 +1,12 @@
 package percy
 
 import (
-	"crypto/sha256"
+	"crypto/rand"
 	"fmt"
 	"log"
 	"net"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/fluffy/rtp"
@@ -12,6 +14,14 @@ import (
 
 type AssociationID uint16
 
+const (
+	defaultIdleTimeout     = 10 * time.Second
+	defaultConsentTimeout  = 30 * time.Second
+	defaultSweepInterval   = 1 * time.Second
+	defaultRTCPInterval    = 1 * time.Second
+	defaultSpeakerInterval = 100 * time.Millisecond
+)
+
 type dtlsSRTPPacketClass uint8
 
 const (
@@ -34,8 +44,8 @@ func packetClass(msg []byte) dtlsSRTPPacketClass {
 	B := msg[0]
 	switch {
 	case 127 < B && B < 192:
-		PT := msg[1]
-		if PT >= 200 && PT <= 205 {
+		// https://tools.ietf.org/html/rfc5761#section-4
+		if len(msg) > 1 && msg[1] >= 192 && msg[1] <= 223 {
 			return packetClassSRTCP
 		}
 
@@ -56,54 +66,272 @@ type packet struct {
 	msg  []byte
 }
 
-func addrToAssoc(addr *net.UDPAddr) AssociationID {
-	h := sha256.New()
-	h.Write([]byte(addr.String()))
-	sum := h.Sum(nil)
-	return AssociationID((uint16(sum[0]) << 8) + uint16(sum[1]))
+// A client that signaling has told the MDD to expect.  The local ICE
+// credentials are the ones the MD put in its SDP for this client, and the
+// remote ones come from the client's SDP.
+type ClientRegistration struct {
+	LocalUfrag  string
+	LocalPwd    string
+	RemoteUfrag string
+	RemotePwd   string
+	Conf        ConfID
 }
 
-type MDD struct {
-	name         string
-	addr         *net.UDPAddr
-	conn         *net.UDPConn
-	clients      map[AssociationID]*net.UDPAddr
-	recvSessions map[AssociationID]*rtp.RTPSession
-	sendSessions map[AssociationID]*rtp.RTPSession
-	stopChan     chan bool
-	doneChan     chan bool
-	packetChan   chan packet
-	timeout      time.Duration
+// The USERNAME a client will use in connectivity checks to the MD
+// https://tools.ietf.org/html/rfc5245#section-7.1.2.3
+func (reg ClientRegistration) username() string {
+	return reg.LocalUfrag + ":" + reg.RemoteUfrag
+}
+
+type mddClient struct {
+	addr        *net.UDPAddr
+	reg         ClientRegistration
+	lastSeen    time.Time // last packet of any kind
+	lastConsent time.Time // last authenticated connectivity check
+
+	// Whether the KD has been told which profiles the MD supports
+	profilesSent bool
+
+	// Per-receiver header rewriting state, with audio slots keyed by
+	// Destination.slot; see rewrite.go
+	slots   map[int]AssociationID
+	streams map[mediaSource]*seqRewriter
+
+	// Video sources this client has been getting since a keyframe; see
+	// keyframe.go
+	decoding map[mediaSource]bool
+
+	// Packets recently sent to this client; see nack.go
+	sent map[mediaSource]*packetCache
 
+	// The simulcast layer (SSRC) this client gets from each sender; see
+	// simulcast.go
+	layers map[AssociationID]uint32
+
+	// The highest temporal layer this client gets from each source; see
+	// temporal.go
+	temporal map[mediaSource]uint8
+}
+
+// The MD has a single socket, so the remote address is all that is
+// needed to identify the 5-tuple a packet arrived on
+func transportKey(addr *net.UDPAddr) string {
+	return addr.String()
+}
+
+// Concurrency: the MDD is driven by three kinds of goroutine -- the
+// socket reader, the packet loop started by Listen, and whatever goroutines
+// the KD tunnel uses to call Send and SetKeys.  All association state
+// (clients, RTP sessions, keys and extension IDs) is guarded by mu.  The
+// packet loop holds mu while it forwards a packet, so a key change or new
+// client is never observed half-way through.  Calls out to the KD are made
+// without holding mu, so a tunnel may call back into the MDD synchronously.
+type MDD struct {
+	mu sync.Mutex
+
+	name        string
+	addr        *net.UDPAddr
+	conn        *net.UDPConn
+	clients     map[AssociationID]*mddClient
+	transports  map[string]AssociationID // by transportKey
+	usernames   map[string]AssociationID // by STUN USERNAME
+	nextAssocID AssociationID
+	stopChan    chan bool
+	doneChan    chan bool
+	packetChan  chan packet
+	timeout     time.Duration
+
+	// Associations are torn down when nothing has been received for
+	// IdleTimeout, or when the client has not refreshed consent for
+	// ConsentTimeout (RFC 7675).  Zero disables either check.  These should
+	// be set before calling Listen.
+	IdleTimeout    time.Duration
+	ConsentTimeout time.Duration
+	sweepInterval  time.Duration
+
+	// How often the SFU re-evaluates speakers when no packets arrive
+	speakerInterval time.Duration
+
+	// Clients that signaling has told us to expect, by STUN USERNAME
+	registrations map[string]ClientRegistration
+
+	// Server mutes of registered clients whose associations have gone, so
+	// that reconnecting doesn't undo them, by STUN USERNAME
+	serverMutes map[string]MuteState
+
+	// The SFU decides which clients receive each packet
+	SFU *SFU
+
+	// Header extension IDs negotiated in SDP, keyed by URI
+	extensions map[string]uint8
+
+	// Keys for each association, and the double-GCM profiles the MD is
+	// willing to let the KD negotiate
 	KD       KMFTunnel
 	keys     map[AssociationID]HBHKeys
-	profile  ProtectionProfile
 	profiles []ProtectionProfile
-	// TODO add some mutexes
+
+	// The outer (hop-by-hop) SRTP layer for each association, in each
+	// direction, and SRTCP, which only has the one layer
+	hbhRecv  map[AssociationID]*srtpContext
+	hbhSend  map[AssociationID]*srtpContext
+	rtcpRecv map[AssociationID]*srtcpContext
+	rtcpSend map[AssociationID]*srtcpContext
+
+	// Full EKT fields and SPIs seen from senders
+	ekt *ektState
+
+	// Reception statistics for each source, and which association each
+	// SSRC belongs to.  The MD reports on what it receives under its own
+	// SSRC every rtcpInterval.
+	recvStats    map[mediaSource]*receiverStats
+	ssrcOwners   map[uint32]AssociationID
+	ssrc         uint32
+	rtcpInterval time.Duration
+
+	// When the MD last asked each source for a keyframe
+	keyframeRequests map[mediaSource]time.Time
+	keyframeInterval time.Duration
+
+	// Who got the last packet from each video source, so that only they
+	// need checking when the receivers change
+	videoReceivers map[mediaSource]map[AssociationID]bool
+
+	// Bandwidth estimates for each receiver; see bwe.go
+	bwe map[AssociationID]*bandwidthEstimator
+
+	// Simulcast layers from each sender, and the RIDs that identify them
+	simulcast     map[AssociationID]*simulcastSender
+	simulcastRIDs []string
 }
 
 func NewMDD() *MDD {
 	mdd := new(MDD)
 	mdd.name = "mdd"
-	mdd.clients = map[AssociationID]*net.UDPAddr{}
-	mdd.recvSessions = map[AssociationID]*rtp.RTPSession{}
-	mdd.sendSessions = map[AssociationID]*rtp.RTPSession{}
+	mdd.clients = map[AssociationID]*mddClient{}
+	mdd.transports = map[string]AssociationID{}
+	mdd.usernames = map[string]AssociationID{}
+	mdd.nextAssocID = 1
+	mdd.registrations = map[string]ClientRegistration{}
+	mdd.serverMutes = map[string]MuteState{}
 	mdd.timeout = 10 * time.Millisecond
+	mdd.IdleTimeout = defaultIdleTimeout
+	mdd.ConsentTimeout = defaultConsentTimeout
+	mdd.sweepInterval = defaultSweepInterval
+	mdd.speakerInterval = defaultSpeakerInterval
+	mdd.extensions = map[string]uint8{}
 
 	mdd.stopChan = make(chan bool)
 	mdd.doneChan = make(chan bool)
 	mdd.packetChan = make(chan packet)
 
-	// TODO Add some defaults
-	mdd.profiles = []ProtectionProfile{}
+	mdd.profiles = []ProtectionProfile{
+		ProtectionProfile(rtp.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM),
+		ProtectionProfile(rtp.DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM),
+	}
 	mdd.keys = map[AssociationID]HBHKeys{}
+	mdd.hbhRecv = map[AssociationID]*srtpContext{}
+	mdd.hbhSend = map[AssociationID]*srtpContext{}
+	mdd.ekt = newEKTState()
+	mdd.rtcpRecv = map[AssociationID]*srtcpContext{}
+	mdd.rtcpSend = map[AssociationID]*srtcpContext{}
+	mdd.recvStats = map[mediaSource]*receiverStats{}
+	mdd.ssrcOwners = map[uint32]AssociationID{}
+	mdd.ssrc = randomSSRC()
+	mdd.rtcpInterval = defaultRTCPInterval
+	mdd.keyframeRequests = map[mediaSource]time.Time{}
+	mdd.videoReceivers = map[mediaSource]map[AssociationID]bool{}
+	mdd.keyframeInterval = defaultKeyframeInterval
+	mdd.bwe = map[AssociationID]*bandwidthEstimator{}
+	mdd.simulcast = map[AssociationID]*simulcastSender{}
+	mdd.simulcastRIDs = defaultSimulcastRIDs
 
 	return mdd
 }
 
+// The length of the outer (hop-by-hop) key for a double-GCM profile
+func hbhKeyLength(profile ProtectionProfile) (int, bool) {
+	switch rtp.CipherID(profile) {
+	case rtp.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM:
+		return 16, true
+	case rtp.DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM:
+		return 32, true
+	default:
+		return 0, false
+	}
+}
+
+func randomSSRC() uint32 {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return readUint32(buf[:])
+}
+
+// Set the SRTP protection profiles the KD may negotiate, in order of
+// preference.  Only double-GCM profiles are allowed, since those are the
+// only ones the MD can re-encrypt.  Associations that have already started
+// their handshake are not affected.
+func (mdd *MDD) SetProfiles(profiles []ProtectionProfile) error {
+	if len(profiles) == 0 {
+		return fmt.Errorf("No SRTP protection profiles")
+	}
+
+	for _, profile := range profiles {
+		if _, ok := hbhKeyLength(profile); !ok {
+			return fmt.Errorf("Unsupported SRTP protection profile [%04x]", uint16(profile))
+		}
+	}
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	mdd.profiles = append([]ProtectionProfile{}, profiles...)
+	return nil
+}
+
+func (mdd *MDD) supportsProfile(profile ProtectionProfile) bool {
+	for _, p := range mdd.profiles {
+		if p == profile {
+			return true
+		}
+	}
+	return false
+}
+
 func (mdd *MDD) handleDTLS(assocID AssociationID, msg []byte) {
-	// TODO Notify the KD of supported SRTP profiles
-	mdd.KD.Send(assocID, msg)
+	// The supported profiles go along with the first record the KD sees
+	// for each association, which will be the ClientHello
+	mdd.mu.Lock()
+	client, ok := mdd.clients[assocID]
+	if !ok {
+		mdd.mu.Unlock()
+		return
+	}
+
+	var profiles []ProtectionProfile
+	if !client.profilesSent {
+		profiles = append(profiles, mdd.profiles...)
+	}
+	mdd.mu.Unlock()
+
+	var err error
+	if profiles != nil {
+		err = mdd.KD.SendWithProfiles(assocID, msg, profiles)
+	} else {
+		err = mdd.KD.Send(assocID, msg)
+	}
+
+	if err != nil {
+		log.Printf("Error forwarding DTLS packet to KD: %v", err)
+		return
+	}
+
+	// Only stop sending the profiles once the KD has them
+	if profiles != nil {
+		mdd.mu.Lock()
+		client.profilesSent = true
+		mdd.mu.Unlock()
+	}
 }
 
 func (mdd *MDD) handleHBHKey(assocID AssociationID, msg []byte) {
@@ -111,22 +339,280 @@ func (mdd *MDD) handleHBHKey(assocID AssociationID, msg []byte) {
 }
 
 func (mdd *MDD) broadcast(assocID AssociationID, msg []byte) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
 	// Send the packet out to all the clients except
 	// the one that sent it
-	for client, addr := range mdd.clients {
+	for client, info := range mdd.clients {
 		if client == assocID {
 			continue
 		}
 
-		//log.Printf("Client <-- MD for %v[%v] with [%d] bytes", client, addr, len(msg))
+		//log.Printf("Client <-- MD for %v[%v] with [%d] bytes", client, info.addr, len(msg))
 
-		_, err := mdd.conn.WriteToUDP(msg, addr)
+		_, err := mdd.conn.WriteToUDP(msg, info.addr)
 		if err != nil {
 			log.Printf("Error forwarding packet")
 		}
 	}
 }
 
+// Tell the MDD to expect a client.  Packets from a client are only
+// accepted once it has sent a connectivity check that authenticates with
+// these credentials.
+func (mdd *MDD) AdmitClient(reg ClientRegistration) error {
+	if len(reg.LocalUfrag) == 0 || len(reg.LocalPwd) == 0 || len(reg.RemoteUfrag) == 0 {
+		return fmt.Errorf("Incomplete ICE credentials")
+	}
+
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	mdd.registrations[reg.username()] = reg
+	return nil
+}
+
+// Stop expecting a client.  Associations that have already been
+// established are not affected.
+func (mdd *MDD) RevokeClient(reg ClientRegistration) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	delete(mdd.registrations, reg.username())
+	delete(mdd.serverMutes, reg.username())
+}
+
+// The ID the SFU knows a client by, once its connectivity checks have
+// established an association
+func (mdd *MDD) ClientID(reg ClientRegistration) (ClientID, bool) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	assocID, ok := mdd.usernames[reg.username()]
+	return ClientID(assocID), ok
+}
+
+// Authenticate a STUN request against the registered clients
+func (mdd *MDD) authenticateSTUN(message *STUNMessage, msg []byte) (ClientRegistration, error) {
+	username, ok := message.Get(ATTR_USERNAME)
+	if !ok {
+		return ClientRegistration{}, fmt.Errorf("No USERNAME")
+	}
+
+	mdd.mu.Lock()
+	reg, ok := mdd.registrations[string(username)]
+	mdd.mu.Unlock()
+	if !ok {
+		return ClientRegistration{}, fmt.Errorf("Unknown USERNAME [%s]", username)
+	}
+
+	if err := CheckFingerprint(msg); err != nil {
+		return ClientRegistration{}, err
+	}
+
+	if err := CheckMessageIntegrity(msg, reg.LocalPwd); err != nil {
+		return ClientRegistration{}, err
+	}
+
+	return reg, nil
+}
+
+// Find an association ID that is not in use.  Zero is never allocated,
+// so that it can't be confused with an unset ID.
+func (mdd *MDD) allocateAssocID() (AssociationID, error) {
+	for i := 0; i < 0xFFFF; i += 1 {
+		assocID := mdd.nextAssocID
+		mdd.nextAssocID += 1
+		if mdd.nextAssocID == 0 {
+			mdd.nextAssocID = 1
+		}
+
+		if _, ok := mdd.clients[assocID]; !ok {
+			return assocID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("No association IDs available")
+}
+
+// Look up the association for a transport address
+func (mdd *MDD) lookupAssoc(addr *net.UDPAddr) (AssociationID, bool) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	assocID, ok := mdd.transports[transportKey(addr)]
+	return assocID, ok
+}
+
+// Look up the association for a packet that just arrived, and note that
+// the client is still alive
+func (mdd *MDD) touchAssoc(addr *net.UDPAddr, now time.Time) (AssociationID, bool) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	assocID, ok := mdd.transports[transportKey(addr)]
+	if ok {
+		mdd.clients[assocID].lastSeen = now
+	}
+	return assocID, ok
+}
+
+// Bind a transport address to the association for an authenticated
+// client, creating the association if this is the first time the client
+// has been seen.  An existing association only moves to a new address when
+// the check was nominated (USE-CANDIDATE), i.e. when ICE has chosen that
+// path.
+func (mdd *MDD) bindClient(addr *net.UDPAddr, reg ClientRegistration, nominated bool) error {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	now := time.Now()
+	key := transportKey(addr)
+	if assocID, ok := mdd.transports[key]; ok {
+		mdd.clients[assocID].lastConsent = now
+		return nil
+	}
+
+	if assocID, ok := mdd.usernames[reg.username()]; ok {
+		if !nominated {
+			return nil
+		}
+
+		client := mdd.clients[assocID]
+		log.Printf("Moving client [%04x] from %v to %v", assocID, client.addr, addr)
+
+		delete(mdd.transports, transportKey(client.addr))
+		client.addr = addr
+		client.lastSeen = now
+		client.lastConsent = now
+		mdd.transports[key] = assocID
+		return nil
+	}
+
+	assocID, err := mdd.allocateAssocID()
+	if err != nil {
+		return err
+	}
+
+	// A client the SFU won't take (e.g., because the conference is full)
+	// has to be admitted again
+	if mdd.SFU != nil {
+		err := mdd.SFU.AddClient(reg.Conf, ClientID(assocID))
+		if err != nil {
+			delete(mdd.registrations, reg.username())
+			return fmt.Errorf("Error adding client [%04x] to conference: %v", assocID, err)
+		}
+
+		if mute, ok := mdd.serverMutes[reg.username()]; ok {
+			mdd.SFU.ServerMute(ClientID(assocID), mute.ServerAudio, mute.ServerVideo)
+			delete(mdd.serverMutes, reg.username())
+		}
+	}
+
+	log.Printf("Admitting client [%04x] at %v to conference [%v]", assocID, addr, reg.Conf)
+
+	mdd.clients[assocID] = &mddClient{
+		addr:        addr,
+		reg:         reg,
+		lastSeen:    now,
+		lastConsent: now,
+	}
+	mdd.transports[key] = assocID
+	mdd.usernames[reg.username()] = assocID
+	return nil
+}
+
+// Tear down an association: free its RTP sessions and keys, take it out
+// of its conference, and tell the KD that it is gone
+func (mdd *MDD) RemoveClient(assocID AssociationID) error {
+	mdd.mu.Lock()
+	ok := mdd.removeClient(assocID)
+	mdd.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Unknown client [%04x]", assocID)
+	}
+
+	if mdd.KD != nil {
+		return mdd.KD.Close(assocID)
+	}
+	return nil
+}
+
+func (mdd *MDD) removeClient(assocID AssociationID) bool {
+	client, ok := mdd.clients[assocID]
+	if !ok {
+		return false
+	}
+
+	log.Printf("Removing client [%04x] at %v", assocID, client.addr)
+
+	delete(mdd.clients, assocID)
+	delete(mdd.transports, transportKey(client.addr))
+	delete(mdd.usernames, client.reg.username())
+	delete(mdd.keys, assocID)
+	delete(mdd.hbhRecv, assocID)
+	delete(mdd.hbhSend, assocID)
+	delete(mdd.rtcpRecv, assocID)
+	delete(mdd.rtcpSend, assocID)
+	delete(mdd.bwe, assocID)
+	delete(mdd.simulcast, assocID)
+	mdd.ekt.remove(assocID)
+	for src := range mdd.recvStats {
+		if src.assocID == assocID {
+			delete(mdd.recvStats, src)
+			delete(mdd.ssrcOwners, src.ssrc)
+			delete(mdd.keyframeRequests, src)
+			delete(mdd.videoReceivers, src)
+		}
+	}
+	for _, other := range mdd.clients {
+		other.removeSource(assocID)
+	}
+
+	if mdd.SFU != nil {
+		mute := mdd.SFU.MuteState(ClientID(assocID))
+		if _, registered := mdd.registrations[client.reg.username()]; registered && (mute.ServerAudio || mute.ServerVideo) {
+			mdd.serverMutes[client.reg.username()] = mute
+		}
+
+		err := mdd.SFU.RemoveClient(client.reg.Conf, ClientID(assocID))
+		if err != nil {
+			log.Printf("Error removing client [%04x] from conference: %v", assocID, err)
+		}
+
+		if len(mdd.SFU.Members(client.reg.Conf)) == 0 {
+			mdd.ekt.removeConf(client.reg.Conf)
+		}
+	}
+
+	return true
+}
+
+// Find the associations that have gone quiet or lost consent
+func (mdd *MDD) expiredClients(now time.Time) []AssociationID {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	var expired []AssociationID
+	for assocID, client := range mdd.clients {
+		idle := mdd.IdleTimeout > 0 && now.Sub(client.lastSeen) > mdd.IdleTimeout
+		noConsent := mdd.ConsentTimeout > 0 && now.Sub(client.lastConsent) > mdd.ConsentTimeout
+		if idle || noConsent {
+			expired = append(expired, assocID)
+		}
+	}
+	return expired
+}
+
+func (mdd *MDD) expireClients(now time.Time) {
+	for _, assocID := range mdd.expiredClients(now) {
+		log.Printf("Client [%04x] timed out", assocID)
+		mdd.RemoveClient(assocID)
+	}
+}
+
 func (mdd *MDD) handleSTUN(addr *net.UDPAddr, msg []byte) {
 	message, err := ParseSTUN(msg)
 	if err != nil {
@@ -138,12 +624,25 @@ func (mdd *MDD) handleSTUN(addr *net.UDPAddr, msg []byte) {
 
 	switch message.msgType {
 	case MSG_TYPE_REQUEST:
+		// Silently drop requests that don't come from a registered client
+		reg, err := mdd.authenticateSTUN(message, msg)
+		if err != nil {
+			log.Printf("Dropping unauthenticated STUN request from %v: %v", addr, err)
+			return
+		}
+
 		response := STUNMessage{header: message.header}
 		switch message.header.Type {
 		case MSG_BINDING:
+			_, nominated := message.Get(ATTR_USE_CANDIDATE)
+			err = mdd.bindClient(addr, reg, nominated)
+			if err != nil {
+				log.Printf("Error admitting client at %v: %v", addr, err)
+				return
+			}
+
 			response.msgType = MSG_TYPE_SUCCESS
-			// 22 to 256 alphanumeric characters
-			response.icePassword = "abcdefabcdefabcdefabcdefabcdefab"
+			response.icePassword = reg.LocalPwd
 			response.AddXorMappedAddress(addr)
 			response.AddMessageIntegrity()
 			response.AddFingerprint()
@@ -174,103 +673,370 @@ func (mdd *MDD) handleSTUN(addr *net.UDPAddr, msg []byte) {
 }
 
 func (mdd *MDD) handleSRTP(assocID AssociationID, msg []byte) {
-	if msg[len(msg)-1] != 0x00 && msg[len(msg)-1] != 0x02 {
-		log.Printf("Got non-EKT SRTP packet: %x", msg)
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	if mdd.SFU == nil {
+		log.Printf("Got an SRTP packet with no SFU configured")
+		return
 	}
 
-	// Decode the packet
-	sendSession, ok := mdd.recvSessions[assocID]
+	sender, ok := mdd.clients[assocID]
 	if !ok {
-		log.Printf("Got an SRTP packet with no RTP session set up")
 		return
 	}
 
-	pkt, err := sendSession.Decode(msg)
+	// The EKT field trails the SRTP authentication tag, so it has to come
+	// off before the packet can be decoded
+	srtp, field, err := splitEKTField(msg)
+	if err != nil {
+		log.Printf("Error parsing EKT field: %v", err)
+		return
+	}
+
+	// Remove the hop-by-hop layer
+	hbh, ok := mdd.hbhRecv[assocID]
+	if !ok {
+		log.Printf("Got an SRTP packet with no keys set up")
+		return
+	}
+
+	pkt, err := hbh.unprotectHBH(srtp)
 	if err != nil {
 		log.Printf("Error decoding RTP packet: %v", err)
 		return
 	}
+	hdr := pkt.hdr
+
+	src := mediaSource{assocID: assocID, ssrc: hdr.ssrc}
+	err = mdd.ekt.receive(sender.reg.Conf, src, field)
+	if err != nil {
+		log.Printf("Dropping SRTP packet from [%04x]: %v", assocID, err)
+		return
+	}
+
+	// Feed the client-to-mixer audio level to the SFU
+	if id, ok := mdd.extensions[ExtensionAudioLevel]; ok {
+		if ext, ok := hdr.extensions[id]; ok {
+			level, vad, err := parseAudioLevel(ext)
+			if err != nil {
+				log.Printf("Error parsing audio level: %v", err)
+			} else {
+				mdd.SFU.UpdateEnergy(ClientID(assocID), level, vad)
+			}
+		}
+	}
+
+	stats, ok := mdd.recvStats[src]
+	if !ok {
+		if owner, taken := mdd.ssrcOwners[hdr.ssrc]; taken && owner != assocID {
+			log.Printf("Dropping SRTP packet from [%04x]: SSRC %08x is in use", assocID, hdr.ssrc)
+			return
+		}
+
+		clockRate := uint32(videoClockRate)
+		if mdd.SFU.isAudioPT(int8(hdr.pt)) {
+			clockRate = audioClockRate
+		}
+
+		stats = newReceiverStats(hdr.seq, clockRate)
+		mdd.recvStats[src] = stats
+		mdd.ssrcOwners[hdr.ssrc] = assocID
+	}
+	now := time.Now()
+	stats.update(hdr.seq, hdr.timestamp, now)
+	stats.bytes += uint64(len(msg))
+	count := stats.received
+	fm, marked := mdd.frameMarking(hdr)
+	keyframe := marked && fm.keyframe()
+
+	var sim *simulcastSender
+	if !mdd.SFU.isAudioPT(int8(hdr.pt)) {
+		sim = mdd.simulcastPacket(src, hdr)
+	}
+
+	// Ask the SFU who should get this packet, and in which audio slot
+	dests := mdd.SFU.GetFibEntry(ClientID(assocID), int8(hdr.pt))
 
-	// Re-encode the packet for each recipient and send
-	for receiver, addr := range mdd.clients {
+	// Re-apply the hop-by-hop layer for each recipient and send
+	getting := map[AssociationID]bool{}
+	for _, dest := range dests {
+		receiver := AssociationID(dest.clientID)
 		if receiver == assocID {
 			continue
 		}
 
-		recvSession, ok := mdd.sendSessions[receiver]
+		client, ok := mdd.clients[receiver]
 		if !ok {
-			log.Printf("No SRTP session for recipient [%v]", receiver)
+			log.Printf("No address for recipient [%v]", receiver)
 			continue
 		}
 
-		outPkt := pkt.Clone()
-		msg, err := recvSession.Encode(outPkt)
-		if err != nil {
-			log.Printf("Error encoding packet for [%v] [%v]", receiver, err)
+		out, ok := mdd.hbhSend[receiver]
+		if !ok {
+			log.Printf("No SRTP keys for recipient [%v]", receiver)
+			continue
+		}
+
+		// Only one simulcast layer goes to each receiver
+		if sim != nil && dest.pt == 0 && !mdd.forwardLayer(client, src, sim, dest, keyframe, marked, now) {
 			continue
 		}
+		getting[receiver] = true
 
-		//log.Printf("Client <-- MD for %v[%v] with [%d] bytes: %x", receiver, addr, len(msg), msg)
+		// Some receivers only get the lower temporal layers
+		if marked && dest.pt == 0 && !client.forwardTemporal(src, fm, dest.maxTID) {
+			continue
+		}
+
+		// Receivers switching to this source need a keyframe first
+		if client.awaitingKeyframe(src, dest) {
+			if !keyframe {
+				mdd.requestKeyframe(src, now)
+			}
+
+			if marked && !keyframe {
+				continue
+			}
+			client.decoding[src] = true
+		}
 
-		_, err = mdd.conn.WriteToUDP(msg, addr)
+		outPkt := client.rewrite(pkt, src, count, dest)
+		if outPkt == nil {
+			continue
+		}
+		client.cache(src, outPkt)
+		msg := out.protectHBH(outPkt)
+		msg = append(msg, mdd.ekt.forward(receiver, src, field).marshal()...)
+
+		//log.Printf("Client <-- MD for %v[%v] with [%d] bytes: %x", receiver, client.addr, len(msg), msg)
+
+		_, err = mdd.conn.WriteToUDP(msg, client.addr)
 		if err != nil {
 			log.Printf("Error forwarding packet to [%v] [%v]", receiver, err)
 			continue
 		}
+
+		mdd.estimator(receiver).sent(len(msg), now)
+	}
+
+	if !mdd.SFU.isAudioPT(int8(hdr.pt)) {
+		mdd.stopDecoding(src, getting)
 	}
 }
 
 func (mdd *MDD) handleSRTCP(assocID AssociationID, msg []byte) {
-	log.Printf("Received SRTCP")
+	if mdd.routeRTCP(assocID, msg, time.Now()) {
+		log.Printf("Client [%04x] said BYE", assocID)
+		mdd.RemoveClient(assocID)
+	}
+}
+
+// Process a compound RTCP packet from a client, and forward the parts
+// other clients need.  Returns true if the client said BYE for all of its
+// sources.
+func (mdd *MDD) routeRTCP(assocID AssociationID, msg []byte, now time.Time) bool {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
 
-	// Decode the packet
-	sendSession, ok := mdd.recvSessions[assocID]
+	sender, ok := mdd.clients[assocID]
 	if !ok {
-		log.Printf("Got an SRTP packet with no RTP session set up")
-		return
+		return false
+	}
+
+	ctx, ok := mdd.rtcpRecv[assocID]
+	if !ok {
+		log.Printf("Got an SRTCP packet with no keys set up")
+		return false
 	}
 
-	pkt, err := sendSession.DecodeRTCP(msg)
+	plaintext, err := ctx.unprotect(msg)
 	if err != nil {
-		log.Printf("Error decoding RTP packet: %v", err)
-		return
+		log.Printf("Error decoding RTCP packet: %v", err)
+		return false
 	}
 
-	// Only send receiver reports
-	if pkt.GetHeader().GetPT() != rtp.RTCPTypeRR {
-		return
+	pkts, err := splitRTCP(plaintext)
+	if err != nil {
+		log.Printf("Error parsing RTCP packet: %v", err)
+		return false
 	}
 
-	log.Printf("Received RTCP Receiver Report")
+	// Packets to send on, by recipient
+	out := map[AssociationID][]rtcpPacket{}
+	toConf := func(pkt rtcpPacket) {
+		for receiver, client := range mdd.clients {
+			if receiver != assocID && client.reg.Conf == sender.reg.Conf {
+				out[receiver] = append(out[receiver], pkt)
+			}
+		}
+	}
 
-	// Re-encode the packet for each recipient and send
-	for receiver, addr := range mdd.clients {
-		if receiver == assocID {
+	bye := false
+	for _, pkt := range pkts {
+		// A client can only speak for its own sources
+		if owner, ok := mdd.ssrcOwners[pkt.ssrc()]; ok && owner != assocID && !pkt.isFeedback() {
+			log.Printf("Dropping RTCP from [%04x] for SSRC %08x", assocID, pkt.ssrc())
 			continue
 		}
 
-		recvSession, ok := mdd.sendSessions[receiver]
-		if !ok {
-			log.Printf("No SRTCP session for recipient [%v]", receiver)
+		switch pkt.pt() {
+		case rtcpTypeSR:
+			if stats, ok := mdd.recvStats[mediaSource{assocID, pkt.ssrc()}]; ok && len(pkt) >= 16 {
+				ntpTime := uint64(readUint32(pkt[8:]))<<32 | uint64(readUint32(pkt[12:]))
+				stats.senderReport(ntpTime, now)
+			}
+
+			if info := pkt.senderInfo(); info != nil {
+				toConf(info)
+			}
+			mdd.receiverLoss(assocID, pkt.reportBlocks(), now)
+
+		case rtcpTypeRR:
+			// Receivers report to the MD, which reports to senders itself
+			mdd.receiverLoss(assocID, pkt.reportBlocks(), now)
+
+		case rtcpTypeSDES:
+			toConf(pkt)
+
+		case rtcpTypeBYE:
+			toConf(pkt)
+			bye = mdd.removeSources(assocID, pkt.byeSSRCs()) || bye
+
+		case rtcpTypeRTPFB, rtcpTypePSFB:
+			// The MD sends senders its own REMB
+			if pkt.isREMB() {
+				mdd.receiverREMB(assocID, pkt, now)
+				continue
+			}
+
+			// Answer what the MD can of a NACK from its cache
+			if pkt.pt() == rtcpTypeRTPFB && pkt.count() == rtcpFmtNACK {
+				pkt = mdd.answerNACK(assocID, sender, pkt)
+				if pkt == nil {
+					continue
+				}
+			}
+
+			mdd.routeFeedback(sender, assocID, pkt, out)
+
+		default:
+			// XR, APP and so on are not forwarded
+		}
+	}
+
+	for receiver, pkts := range out {
+		mdd.sendRTCP(receiver, pkts)
+	}
+
+	return bye
+}
+
+// Send feedback to the client that sends the media it is about, as long
+// as that client is in the same conference.  NACKs refer to sequence
+// numbers as rewritten for the client sending the feedback, so they are
+// translated back.
+func (mdd *MDD) routeFeedback(sender *mddClient, assocID AssociationID, pkt rtcpPacket, out map[AssociationID][]rtcpPacket) {
+	routed := map[AssociationID]bool{}
+	for _, ssrc := range pkt.feedbackTargets() {
+		owner, ok := mdd.ssrcOwners[ssrc]
+		if !ok || owner == assocID || routed[owner] {
 			continue
 		}
 
-		outPkt := pkt.Clone()
-		msg, err := recvSession.EncodeRTCP(outPkt)
-		if err != nil {
-			log.Printf("Error encoding packet for [%v] [%v]", receiver, err)
+		client, ok := mdd.clients[owner]
+		if !ok || client.reg.Conf != sender.reg.Conf {
 			continue
 		}
 
-		//log.Printf("Client <-- MD for %v[%v] with [%d] bytes: %x", receiver, addr, len(msg), msg)
+		fb := pkt
+		if pkt.pt() == rtcpTypeRTPFB && pkt.count() == rtcpFmtNACK {
+			if stream, ok := sender.streams[mediaSource{owner, ssrc}]; ok {
+				var pids []uint16
+				for _, pid := range pkt.nackPIDs() {
+					if seq, ok := stream.original(pid); ok {
+						pids = append(pids, seq)
+					}
+				}
+				if len(pids) == 0 {
+					continue
+				}
+				fb = newNACK(pkt.ssrc(), ssrc, pids)
+			}
+		}
 
-		_, err = mdd.conn.WriteToUDP(msg, addr)
-		if err != nil {
-			log.Printf("Error forwarding packet to [%v] [%v]", receiver, err)
+		out[owner] = append(out[owner], fb)
+		routed[owner] = true
+	}
+}
+
+// Forget about sources that a client has said BYE for.  Returns true if
+// that leaves the client without any sources.
+func (mdd *MDD) removeSources(assocID AssociationID, ssrcs []uint32) bool {
+	for _, ssrc := range ssrcs {
+		src := mediaSource{assocID, ssrc}
+		if _, ok := mdd.recvStats[src]; !ok {
 			continue
 		}
+
+		delete(mdd.recvStats, src)
+		delete(mdd.ssrcOwners, ssrc)
+		delete(mdd.keyframeRequests, src)
+		delete(mdd.videoReceivers, src)
+		mdd.removeLayer(src)
+	}
+
+	for src := range mdd.recvStats {
+		if src.assocID == assocID {
+			return false
+		}
+	}
+	return true
+}
+
+// Send a compound RTCP packet to a client.  Every compound packet starts
+// with a report from the MD.
+func (mdd *MDD) sendRTCP(receiver AssociationID, pkts []rtcpPacket) {
+	client, ok := mdd.clients[receiver]
+	if !ok {
+		return
+	}
+
+	ctx, ok := mdd.rtcpSend[receiver]
+	if !ok {
+		log.Printf("No SRTCP keys for recipient [%v]", receiver)
+		return
+	}
+
+	if len(pkts) == 0 || pkts[0].pt() != rtcpTypeRR {
+		pkts = append([]rtcpPacket{newReceiverReport(mdd.ssrc, nil)}, pkts...)
+	}
+
+	msg := ctx.protect(joinRTCP(pkts))
+	_, err := mdd.conn.WriteToUDP(msg, client.addr)
+	if err != nil {
+		log.Printf("Error forwarding RTCP to [%v] [%v]", receiver, err)
+	}
+}
+
+// Tell each client how the MD is receiving its media, and how much its
+// receivers can take
+func (mdd *MDD) sendReceiverReports(now time.Time) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	blocks := map[AssociationID][]reportBlock{}
+	for src, stats := range mdd.recvStats {
+		blocks[src.assocID] = append(blocks[src.assocID], stats.report(src.ssrc, now))
 	}
 
+	for assocID, rbs := range blocks {
+		pkts := []rtcpPacket{newReceiverReport(mdd.ssrc, rbs)}
+		if remb := mdd.senderREMB(assocID, now); remb != nil {
+			pkts = append(pkts, remb)
+		}
+		mdd.sendRTCP(assocID, pkts)
+	}
 }
 
 func (mdd *MDD) Listen(port int) error {
@@ -284,11 +1050,11 @@ func (mdd *MDD) Listen(port int) error {
 
 	mdd.packetChan = make(chan packet, 10)
 
-	go func(packetChan chan packet) {
+	go func(conn *net.UDPConn, packetChan chan packet, stopChan chan bool) {
 		buf := make([]byte, 2048)
 
 		for {
-			n, addr, err := mdd.conn.ReadFromUDP(buf)
+			n, addr, err := conn.ReadFromUDP(buf)
 
 			if err == nil {
 				pkt := packet{
@@ -297,14 +1063,34 @@ func (mdd *MDD) Listen(port int) error {
 				}
 				copy(pkt.msg, buf[:n])
 
-				packetChan <- pkt
+				select {
+				case packetChan <- pkt:
+				case <-stopChan:
+					return
+				}
+				continue
 			}
 
-			// TODO log errors
+			// The socket is closed by Stop
+			select {
+			case <-stopChan:
+				return
+			default:
+				log.Printf("Error reading from socket: %v", err)
+			}
 		}
-	}(mdd.packetChan)
+	}(mdd.conn, mdd.packetChan, mdd.stopChan)
 
 	go func(mdd *MDD) {
+		sweep := time.NewTicker(mdd.sweepInterval)
+		defer sweep.Stop()
+
+		reports := time.NewTicker(mdd.rtcpInterval)
+		defer reports.Stop()
+
+		speakers := time.NewTicker(mdd.speakerInterval)
+		defer speakers.Stop()
+
 		for {
 			var pkt packet
 
@@ -312,41 +1098,38 @@ func (mdd *MDD) Listen(port int) error {
 			case <-mdd.stopChan:
 				mdd.doneChan <- true
 				return
+			case now := <-sweep.C:
+				mdd.expireClients(now)
+				continue
+			case now := <-reports.C:
+				mdd.updateLayers(now)
+				mdd.sendReceiverReports(now)
+				continue
+			case now := <-speakers.C:
+				if mdd.SFU != nil {
+					mdd.SFU.UpdateSpeakers(now)
+				}
+				continue
 			case <-time.After(mdd.timeout):
 				continue
 			case pkt = <-mdd.packetChan:
 			}
 
-			if err != nil {
-				log.Printf("Recv Error: %v", err)
-				continue
-			}
-
-			assocID := addrToAssoc(pkt.addr)
+			assocID, known := mdd.touchAssoc(pkt.addr, time.Now())
 
 			//log.Printf("Client --> MD for %v[%v] with [%d] bytes", assocID, pkt.addr, len(pkt.msg))
 
-			// Remember the client if it's new
-			// XXX: Could have an interface to add/remove clients, then
-			//      just filter unknown clients here.
-			if _, ok := mdd.clients[assocID]; !ok {
-				mdd.clients[assocID] = pkt.addr
-				mdd.recvSessions[assocID] = rtp.NewRTPSession(false)
-				mdd.sendSessions[assocID] = rtp.NewRTPSession(false)
+			// Only authenticated clients get past this point.  Anything
+			// else from an unknown address has to be a connectivity check.
+			class := packetClass(pkt.msg)
+			if !known && class != packetClassSTUN {
+				continue
 			}
 
-			// XXX: For now, all packets are re-broadcast, which means
-			// this will only really work in cases where there are only
-			// two clients.
-			//
 			// XXX: DTLS packets can be routed to a local DTLS stack as
 			// soon as we have one, and can get the keys out to
 			// re-encrypt.
-			//
-			// XXX: Handling STUN locally will require routing SDP
-			// offer/answer via the MD, so that it can grab the ICE ufrag
-			// and password and use them to synthesize STUN responses.
-			switch packetClass(pkt.msg) {
+			switch class {
 			case packetClassDTLS:
 				mdd.handleDTLS(assocID, pkt.msg)
 			case packetClassSRTP:
@@ -366,64 +1149,93 @@ func (mdd *MDD) Listen(port int) error {
 	return nil
 }
 
+// Tell the MDD which ID was negotiated for a header extension
+// (a=extmap), so that it can find the extension in received packets
+func (mdd *MDD) SetExtensionID(uri string, id uint8) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	mdd.extensions[uri] = id
+}
+
+// The EKT SPIs that senders in a conference have been seen using
+func (mdd *MDD) EKTSPIs(confID ConfID) []uint16 {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	spis := mdd.ekt.confSPIs(confID)
+	sort.Slice(spis, func(i, j int) bool { return spis[i] < spis[j] })
+	return spis
+}
+
 func (mdd *MDD) Send(assocID AssociationID, msg []byte) error {
-	addr, ok := mdd.clients[assocID]
-	// log.Printf("Client <-- MD for %v[%v] with [%d] bytes", assocID, addr, len(msg))
+	mdd.mu.Lock()
+	client, ok := mdd.clients[assocID]
+	mdd.mu.Unlock()
+
+	// log.Printf("Client <-- MD for %v[%v] with [%d] bytes", assocID, client.addr, len(msg))
 	if !ok {
 		return fmt.Errorf("Unknown client [%04x]", assocID)
 	}
 
-	_, err := mdd.conn.WriteToUDP(msg, addr)
+	_, err := mdd.conn.WriteToUDP(msg, client.addr)
 	return err
 }
 
 func (mdd *MDD) SetKeys(assocID AssociationID, keys HBHKeys) error {
-	var cipher rtp.CipherID
-	switch rtp.CipherID(keys.Profile) {
-	case rtp.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM:
-		cipher = rtp.SRTP_AEAD_AES_128_GCM
-	case rtp.DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM:
-		cipher = rtp.SRTP_AEAD_AES_256_GCM
-	default:
+	keyLength, ok := hbhKeyLength(ProtectionProfile(keys.Profile))
+	if !ok {
 		return fmt.Errorf("Unsupported SRTP protection profile")
 	}
 
-	// Set up receive session
-	recvSession, ok := mdd.recvSessions[assocID]
-	if !ok {
-		return fmt.Errorf("Got SetKeys without an RTP session")
+	if len(keys.ClientWriteKey) != keyLength || len(keys.ServerWriteKey) != keyLength {
+		return fmt.Errorf("Wrong key length for SRTP protection profile")
 	}
 
-	log.Printf(" --- MD setting SRTP recv key for [%04x]: %x %x",
-		assocID, keys.ClientWriteKey, keys.MasterSalt)
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	if !mdd.supportsProfile(ProtectionProfile(keys.Profile)) {
+		return fmt.Errorf("KD negotiated a profile the MD did not offer [%04x]", keys.Profile)
+	}
 
-	err := recvSession.SetSRTP(cipher, true, keys.ClientWriteKey, keys.MasterSalt)
+	if _, ok := mdd.clients[assocID]; !ok {
+		return fmt.Errorf("Got SetKeys for unknown client [%04x]", assocID)
+	}
+
+	// The MD handles the hop-by-hop layer of SRTP itself, and all of SRTCP
+	hbhRecv, err := newSRTPContext(keys.ClientWriteKey, keys.ClientWriteSalt)
 	if err != nil {
-		log.Printf("Error setting session read key: %v", err)
 		return err
 	}
 
-	// Set up send session
-	sendSession, ok := mdd.sendSessions[assocID]
-	if !ok {
-		return fmt.Errorf("Got SetKeys without an RTP session")
+	hbhSend, err := newSRTPContext(keys.ServerWriteKey, keys.ServerWriteSalt)
+	if err != nil {
+		return err
 	}
 
-	log.Printf(" --- MD setting SRTP setnd key for [%04x]: %x %x",
-		assocID, keys.ServerWriteKey, keys.MasterSalt)
+	rtcpRecv, err := newSRTCPContext(keys.ClientWriteKey, keys.ClientWriteSalt)
+	if err != nil {
+		return err
+	}
 
-	err = sendSession.SetSRTP(cipher, true, keys.ServerWriteKey, keys.MasterSalt)
+	rtcpSend, err := newSRTCPContext(keys.ServerWriteKey, keys.ServerWriteSalt)
 	if err != nil {
-		log.Printf("Error setting session read key: %v", err)
 		return err
 	}
 
+	log.Printf(" --- MD setting SRTP keys for [%04x]", assocID)
+
 	mdd.keys[assocID] = keys
+	mdd.hbhRecv[assocID] = hbhRecv
+	mdd.hbhSend[assocID] = hbhSend
+	mdd.rtcpRecv[assocID] = rtcpRecv
+	mdd.rtcpSend[assocID] = rtcpSend
 	return nil
 }
 
 func (mdd *MDD) Stop() {
-	mdd.stopChan <- true
+	close(mdd.stopChan)
 	<-mdd.doneChan
 
 	mdd.conn.Close()
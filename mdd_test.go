@@ -1,5 +1,17 @@
 package percy
 
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/assert"
+	"github.com/fluffy/rtp"
+)
+
 // TODO Re-enable unit tests
 /*
 import (
@@ -330,3 +342,1024 @@ func TestDiscrimination(t *testing.T) {
 	AssertNotRecvPacket(t, client1, "DTLS packet forwarded to other client")
 }
 */
+
+type nullKD struct{}
+
+func (kd nullKD) Send(assocID AssociationID, msg []byte) error {
+	return nil
+}
+
+func (kd nullKD) SendWithProfiles(assocID AssociationID, msg []byte, profiles []ProtectionProfile) error {
+	return nil
+}
+
+func (kd nullKD) Close(assocID AssociationID) error {
+	return nil
+}
+
+type kdRecord struct {
+	assocID  AssociationID
+	msg      []byte
+	profiles []ProtectionProfile
+}
+
+type recorderKD struct {
+	nullKD
+	sent chan kdRecord
+}
+
+func (kd recorderKD) Send(assocID AssociationID, msg []byte) error {
+	kd.sent <- kdRecord{assocID: assocID, msg: msg}
+	return nil
+}
+
+func (kd recorderKD) SendWithProfiles(assocID AssociationID, msg []byte, profiles []ProtectionProfile) error {
+	kd.sent <- kdRecord{assocID: assocID, msg: msg, profiles: profiles}
+	return nil
+}
+
+// fails the first send with profiles
+type flakyKD struct {
+	recorderKD
+	failed *bool
+}
+
+func (kd flakyKD) SendWithProfiles(assocID AssociationID, msg []byte, profiles []ProtectionProfile) error {
+	if !*kd.failed {
+		*kd.failed = true
+		return fmt.Errorf("Tunnel down")
+	}
+	return kd.recorderKD.SendWithProfiles(assocID, msg, profiles)
+}
+
+type closeRecorderKD struct {
+	nullKD
+	closed chan AssociationID
+}
+
+func (kd closeRecorderKD) Close(assocID AssociationID) error {
+	kd.closed <- assocID
+	return nil
+}
+
+func testRegistration(i int) ClientRegistration {
+	return ClientRegistration{
+		LocalUfrag:  "fedcbafe",
+		LocalPwd:    "abcdefabcdefabcdefabcdefabcdefab",
+		RemoteUfrag: fmt.Sprintf("client%d", i),
+		RemotePwd:   "0123456789012345678901",
+		Conf:        1,
+	}
+}
+
+func stunBindingRequest(username, password string, nominate bool) []byte {
+	request := STUNMessage{
+		header:      STUNHeader{Type: MSG_BINDING},
+		msgType:     MSG_TYPE_REQUEST,
+		icePassword: password,
+	}
+	rand.Read(request.header.TxnID[:])
+	request.Add(ATTR_USERNAME, []byte(username))
+	if nominate {
+		request.Add(ATTR_USE_CANDIDATE, []byte{})
+	}
+	request.AddMessageIntegrity()
+	request.AddFingerprint()
+
+	msg, _ := request.Serialize()
+	return msg
+}
+
+func newTestMDD(t *testing.T) (*MDD, *net.UDPAddr) {
+	mdd := NewMDD()
+	mdd.SFU = NewSFU([]int8{109, 109})
+	mdd.KD = nullKD{}
+	return mdd, listenTestMDD(t, mdd)
+}
+
+func listenTestMDD(t *testing.T, mdd *MDD) *net.UDPAddr {
+	err := mdd.Listen(0)
+	assert.NotError(t, err, "Error creating MDD")
+
+	serverAddr := &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: mdd.conn.LocalAddr().(*net.UDPAddr).Port,
+	}
+	return serverAddr
+}
+
+// Connect a client and wait for its connectivity check to succeed
+func connectTestClient(t *testing.T, serverAddr *net.UDPAddr, reg ClientRegistration, nominate bool) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, serverAddr)
+	assert.NotError(t, err, "Error creating client")
+
+	_, err = conn.Write(stunBindingRequest(reg.username(), reg.LocalPwd, nominate))
+	assert.NotError(t, err, "Error sending STUN request")
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	assert.NotError(t, err, "No STUN response")
+	assert.NotError(t, CheckMessageIntegrity(buf[:n], reg.LocalPwd), "Bad STUN response")
+	conn.SetReadDeadline(time.Time{})
+
+	return conn
+}
+
+func TestMDDAdmission(t *testing.T) {
+	mdd, serverAddr := newTestMDD(t)
+	defer mdd.Stop()
+
+	reg := testRegistration(0)
+	err := mdd.AdmitClient(reg)
+	assert.NotError(t, err, "Error admitting client")
+
+	err = mdd.AdmitClient(ClientRegistration{LocalUfrag: "a", LocalPwd: "b"})
+	assert.True(t, err != nil, "Admitted a client without a remote ufrag")
+
+	conn, err := net.DialUDP("udp", nil, serverAddr)
+	assert.NotError(t, err, "Error creating client")
+	defer conn.Close()
+
+	// Media, unknown usernames and bad passwords are all dropped
+	srtpPacket := append([]byte{}, rtpHeaderBase...)
+	conn.Write(srtpPacket)
+	conn.Write(stunBindingRequest("fedcbafe:stranger", reg.LocalPwd, true))
+	conn.Write(stunBindingRequest(reg.username(), "not the password", true))
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(buf)
+	assert.True(t, err != nil, "Got a response to an unauthenticated request")
+	assert.Equal(t, len(mdd.SFU.Members(reg.Conf)), 0, "Unauthenticated client admitted")
+	_, ok := mdd.ClientID(reg)
+	assert.True(t, !ok, "Client ID before connectivity check")
+
+	// A good connectivity check admits the client to its conference
+	conn.SetReadDeadline(time.Time{})
+	conn2 := connectTestClient(t, serverAddr, reg, false)
+	defer conn2.Close()
+
+	assocID, ok := mdd.lookupAssoc(conn2.LocalAddr().(*net.UDPAddr))
+	assert.True(t, ok, "No association for client")
+	members := mdd.SFU.Members(reg.Conf)
+	assert.Equal(t, len(members), 1, "Client not admitted to conference")
+	assert.Equal(t, members[0], ClientID(assocID), "Wrong client admitted")
+
+	clientID, ok := mdd.ClientID(reg)
+	assert.True(t, ok && clientID == ClientID(assocID), "Wrong client ID")
+}
+
+func TestMDDAdmissionFull(t *testing.T) {
+	mdd, serverAddr := newTestMDD(t)
+	defer mdd.Stop()
+
+	err := mdd.SFU.CreateConf(1, ConfOptions{MaxClients: 1})
+	assert.NotError(t, err, "Failed to create conference")
+
+	first := testRegistration(0)
+	mdd.AdmitClient(first)
+	conn := connectTestClient(t, serverAddr, first, true)
+	defer conn.Close()
+
+	// A client that doesn't fit in the conference gets no answer, and no
+	// association
+	second := testRegistration(1)
+	mdd.AdmitClient(second)
+	conn2, err := net.DialUDP("udp", nil, serverAddr)
+	assert.NotError(t, err, "Error creating client")
+	defer conn2.Close()
+
+	conn2.Write(stunBindingRequest(second.username(), second.LocalPwd, true))
+	buf := make([]byte, 2048)
+	conn2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn2.Read(buf)
+	assert.True(t, err != nil, "Got a response with the conference full")
+
+	_, ok := mdd.lookupAssoc(conn2.LocalAddr().(*net.UDPAddr))
+	assert.True(t, !ok, "Association left for a client the SFU refused")
+	mdd.mu.Lock()
+	_, ok = mdd.registrations[second.username()]
+	mdd.mu.Unlock()
+	assert.True(t, !ok, "Registration left for a client the SFU refused")
+	assert.Equal(t, len(mdd.SFU.Members(1)), 1, "Conference over its limit")
+}
+
+func TestMDDAssocAllocation(t *testing.T) {
+	mdd := NewMDD()
+
+	// IDs are unique among live associations, and zero is skipped
+	mdd.nextAssocID = 0xFFFE
+	seen := map[AssociationID]bool{}
+	for i := 0; i < 4; i += 1 {
+		assocID, err := mdd.allocateAssocID()
+		assert.NotError(t, err, "Failed to allocate association ID")
+		assert.NotEqual(t, assocID, AssociationID(0), "Allocated association ID zero")
+		assert.True(t, !seen[assocID], "Allocated a duplicate association ID")
+
+		seen[assocID] = true
+		mdd.clients[assocID] = &mddClient{}
+	}
+
+	// Live IDs are skipped when the counter wraps
+	mdd.nextAssocID = 0xFFFE
+	assocID, err := mdd.allocateAssocID()
+	assert.NotError(t, err, "Failed to allocate association ID")
+	assert.Equal(t, assocID, AssociationID(3), "Did not skip live association IDs")
+
+	// Running out of IDs is an error
+	for i := 1; i <= 0xFFFF; i += 1 {
+		mdd.clients[AssociationID(i)] = &mddClient{}
+	}
+	_, err = mdd.allocateAssocID()
+	assert.True(t, err != nil, "Allocated an association ID from a full table")
+}
+
+func TestMDDPathSwitch(t *testing.T) {
+	mdd, serverAddr := newTestMDD(t)
+	defer mdd.Stop()
+
+	reg := testRegistration(0)
+	mdd.AdmitClient(reg)
+
+	conn1 := connectTestClient(t, serverAddr, reg, false)
+	defer conn1.Close()
+	addr1 := conn1.LocalAddr().(*net.UDPAddr)
+	assocID, ok := mdd.lookupAssoc(addr1)
+	assert.True(t, ok, "No association for first path")
+
+	// Checks on another path succeed, but don't move the association
+	conn2 := connectTestClient(t, serverAddr, reg, false)
+	defer conn2.Close()
+	addr2 := conn2.LocalAddr().(*net.UDPAddr)
+	_, ok = mdd.lookupAssoc(addr2)
+	assert.True(t, !ok, "Un-nominated path bound to association")
+
+	// ... until ICE nominates that path
+	conn3 := connectTestClient(t, serverAddr, reg, true)
+	defer conn3.Close()
+	addr3 := conn3.LocalAddr().(*net.UDPAddr)
+	newAssocID, ok := mdd.lookupAssoc(addr3)
+	assert.True(t, ok, "Nominated path not bound to association")
+	assert.Equal(t, newAssocID, assocID, "Association changed on path switch")
+
+	_, ok = mdd.lookupAssoc(addr1)
+	assert.True(t, !ok, "Old path still bound to association")
+	assert.Equal(t, len(mdd.SFU.Members(reg.Conf)), 1, "Path switch changed conference membership")
+
+	// Traffic to the association follows the new path
+	dtlsPacket := []byte{0x16, 0xfe, 0xfd}
+	err := mdd.Send(assocID, dtlsPacket)
+	assert.NotError(t, err, "Error sending to client")
+
+	buf := make([]byte, 2048)
+	conn3.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn3.Read(buf)
+	assert.NotError(t, err, "Packet not sent on new path")
+	assert.BytesEqual(t, buf[:n], dtlsPacket, "Wrong packet on new path")
+}
+
+func TestMDDIdleTimeout(t *testing.T) {
+	kd := closeRecorderKD{closed: make(chan AssociationID, 1)}
+	mdd := NewMDD()
+	mdd.SFU = NewSFU([]int8{109, 109})
+	mdd.KD = kd
+	mdd.IdleTimeout = 200 * time.Millisecond
+	mdd.ConsentTimeout = 0
+	mdd.sweepInterval = 20 * time.Millisecond
+	serverAddr := listenTestMDD(t, mdd)
+	defer mdd.Stop()
+
+	reg := testRegistration(0)
+	mdd.AdmitClient(reg)
+	conn := connectTestClient(t, serverAddr, reg, true)
+	defer conn.Close()
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	assocID, ok := mdd.lookupAssoc(addr)
+	assert.True(t, ok, "Client not admitted")
+	mdd.SetKeys(assocID, HBHKeys{
+		Profile:         uint16(rtp.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM),
+		ClientWriteKey:  make([]byte, 16),
+		ServerWriteKey:  make([]byte, 16),
+		ClientWriteSalt: make([]byte, 12),
+		ServerWriteSalt: make([]byte, 12),
+	})
+
+	// Traffic keeps the association alive
+	for i := 0; i < 5; i += 1 {
+		conn.Write([]byte{0x16, 0xfe, 0xfd})
+		<-time.After(100 * time.Millisecond)
+	}
+	_, ok = mdd.lookupAssoc(addr)
+	assert.True(t, ok, "Active client timed out")
+
+	// Silence does not
+	select {
+	case closed := <-kd.closed:
+		assert.Equal(t, closed, assocID, "KD notified about the wrong association")
+	case <-time.After(time.Second):
+		t.Fatalf("KD not notified of idle association")
+	}
+
+	_, ok = mdd.lookupAssoc(addr)
+	assert.True(t, !ok, "Idle client still bound")
+	assert.Equal(t, len(mdd.SFU.Members(reg.Conf)), 0, "Idle client still in conference")
+
+	mdd.mu.Lock()
+	_, hasSession := mdd.rtcpRecv[assocID]
+	_, hasKeys := mdd.keys[assocID]
+	mdd.mu.Unlock()
+	assert.True(t, !hasSession, "Idle client SRTCP context not freed")
+	assert.True(t, !hasKeys, "Idle client keys not freed")
+
+	err := mdd.RemoveClient(assocID)
+	assert.True(t, err != nil, "Removed a client twice")
+}
+
+func TestMDDServerMuteRejoin(t *testing.T) {
+	mdd, serverAddr := newTestMDD(t)
+	defer mdd.Stop()
+
+	reg := testRegistration(0)
+	mdd.AdmitClient(reg)
+	conn := connectTestClient(t, serverAddr, reg, true)
+	defer conn.Close()
+
+	assocID, ok := mdd.lookupAssoc(conn.LocalAddr().(*net.UDPAddr))
+	assert.True(t, ok, "Client not admitted")
+	mdd.SFU.ServerMute(ClientID(assocID), true, false)
+	mdd.RemoveClient(assocID)
+
+	// Coming back with a new association doesn't undo a server mute
+	conn2 := connectTestClient(t, serverAddr, reg, true)
+	defer conn2.Close()
+
+	assocID2, ok := mdd.lookupAssoc(conn2.LocalAddr().(*net.UDPAddr))
+	assert.True(t, ok && assocID2 != assocID, "Client not admitted again")
+	state := mdd.SFU.MuteState(ClientID(assocID2))
+	assert.True(t, state.ServerAudio && !state.ServerVideo, "Server mute lost on rejoin")
+
+	// ... but a new registration starts afresh
+	mdd.RemoveClient(assocID2)
+	mdd.RevokeClient(reg)
+	mdd.AdmitClient(reg)
+	conn3 := connectTestClient(t, serverAddr, reg, true)
+	defer conn3.Close()
+
+	assocID3, _ := mdd.lookupAssoc(conn3.LocalAddr().(*net.UDPAddr))
+	assert.True(t, !mdd.SFU.MuteState(ClientID(assocID3)).ServerAudio, "Server mute outlived the registration")
+}
+
+func TestMDDConsentTimeout(t *testing.T) {
+	mdd := NewMDD()
+	mdd.IdleTimeout = 0
+	mdd.ConsentTimeout = time.Second
+
+	now := time.Now()
+	mdd.clients[1] = &mddClient{lastSeen: now, lastConsent: now}
+	mdd.clients[2] = &mddClient{lastSeen: now, lastConsent: now.Add(-2 * time.Second)}
+
+	expired := mdd.expiredClients(now)
+	assert.Equal(t, len(expired), 1, "Wrong number of expired clients")
+	assert.Equal(t, expired[0], AssociationID(2), "Wrong client expired")
+}
+
+func TestMDDConcurrentAccess(t *testing.T) {
+	mdd, serverAddr := newTestMDD(t)
+	defer mdd.Stop()
+
+	nClients := 5
+	nPackets := 200
+	keys := HBHKeys{
+		Profile:         uint16(rtp.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM),
+		ClientWriteKey:  make([]byte, 16),
+		ServerWriteKey:  make([]byte, 16),
+		ClientWriteSalt: make([]byte, 12),
+		ServerWriteSalt: make([]byte, 12),
+	}
+
+	// An SRTP packet carrying an audio level, a DTLS record and an SRTCP RR
+	srtpPacket := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	srtpPacket = append(srtpPacket, 0x00)
+	dtlsPacket := []byte{0x16, 0xfe, 0xfd}
+	srtcpPacket := []byte{0x80, 0xc9, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}
+
+	var wg sync.WaitGroup
+	for i := 0; i < nClients; i += 1 {
+		reg := testRegistration(i)
+		mdd.AdmitClient(reg)
+		conn := connectTestClient(t, serverAddr, reg, true)
+		defer conn.Close()
+
+		assocID, _ := mdd.lookupAssoc(conn.LocalAddr().(*net.UDPAddr))
+
+		// The client sends media while the KD installs keys and
+		// sends DTLS on other goroutines
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < nPackets; j += 1 {
+				switch j % 3 {
+				case 0:
+					conn.Write(srtpPacket)
+				case 1:
+					conn.Write(dtlsPacket)
+				case 2:
+					conn.Write(srtcpPacket)
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < nPackets; j += 1 {
+				mdd.SetKeys(assocID, keys)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < nPackets; j += 1 {
+				mdd.Send(assocID, dtlsPacket)
+				mdd.SetExtensionID(ExtensionAudioLevel, 1)
+				mdd.SFU.ActiveSpeakers(reg.Conf)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestMDDProfiles(t *testing.T) {
+	kd := recorderKD{sent: make(chan kdRecord, 1)}
+	mdd := NewMDD()
+	mdd.SFU = NewSFU([]int8{109, 109})
+	mdd.KD = kd
+	serverAddr := listenTestMDD(t, mdd)
+	defer mdd.Stop()
+
+	// Only double-GCM profiles can be configured
+	err := mdd.SetProfiles([]ProtectionProfile{ProtectionProfile(rtp.SRTP_AEAD_AES_128_GCM)})
+	assert.True(t, err != nil, "Configured a profile the MD can't re-encrypt")
+	err = mdd.SetProfiles(nil)
+	assert.True(t, err != nil, "Configured an empty profile list")
+
+	profile := ProtectionProfile(rtp.DOUBLE_AEAD_AES_256_GCM_AEAD_AES_256_GCM)
+	err = mdd.SetProfiles([]ProtectionProfile{profile})
+	assert.NotError(t, err, "Failed to set profiles")
+
+	reg := testRegistration(0)
+	mdd.AdmitClient(reg)
+	conn := connectTestClient(t, serverAddr, reg, true)
+	defer conn.Close()
+	assocID, _ := mdd.lookupAssoc(conn.LocalAddr().(*net.UDPAddr))
+
+	// The first record carries the profiles, later ones don't
+	for i := 0; i < 2; i += 1 {
+		dtlsPacket := []byte{0x16, 0xfe, 0xfd, byte(i)}
+		conn.Write(dtlsPacket)
+
+		select {
+		case rec := <-kd.sent:
+			assert.Equal(t, rec.assocID, assocID, "DTLS sent for the wrong association")
+			assert.BytesEqual(t, rec.msg, dtlsPacket, "Wrong DTLS record sent to KD")
+			if i == 0 {
+				assert.Equal(t, len(rec.profiles), 1, "Profiles not sent with first record")
+				assert.Equal(t, rec.profiles[0], profile, "Wrong profile sent")
+			} else {
+				assert.True(t, rec.profiles == nil, "Profiles sent with later record")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("DTLS record not forwarded to KD")
+		}
+	}
+
+	// Keys for a profile the MD didn't offer are refused
+	keys := HBHKeys{
+		Profile:         uint16(rtp.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM),
+		ClientWriteKey:  make([]byte, 16),
+		ServerWriteKey:  make([]byte, 16),
+		ClientWriteSalt: make([]byte, 12),
+		ServerWriteSalt: make([]byte, 12),
+	}
+	err = mdd.SetKeys(assocID, keys)
+	assert.True(t, err != nil, "Accepted keys for a profile that wasn't offered")
+}
+
+func TestMDDProfilesRetry(t *testing.T) {
+	kd := flakyKD{recorderKD: recorderKD{sent: make(chan kdRecord, 1)}, failed: new(bool)}
+	mdd := NewMDD()
+	mdd.KD = kd
+	mdd.clients[1] = &mddClient{}
+
+	// The profiles go with the next record if the first send fails
+	mdd.handleDTLS(1, []byte{0x16, 0xfe, 0xfd, 0})
+	mdd.handleDTLS(1, []byte{0x16, 0xfe, 0xfd, 1})
+	rec := <-kd.sent
+	assert.True(t, *kd.failed, "First send didn't fail")
+	assert.Equal(t, len(rec.profiles), len(mdd.profiles), "Profiles not sent after a failure")
+
+	mdd.handleDTLS(1, []byte{0x16, 0xfe, 0xfd, 2})
+	rec = <-kd.sent
+	assert.True(t, rec.profiles == nil, "Profiles sent again after success")
+}
+
+// Connect two clients with HBH keys A and B
+func connectKeyedClients(t *testing.T, mdd *MDD, serverAddr *net.UDPAddr) []*net.UDPConn {
+	keyA := HBHKeys{
+		Profile:         uint16(rtp.DOUBLE_AEAD_AES_128_GCM_AEAD_AES_128_GCM),
+		ClientWriteKey:  hbhKeyA,
+		ServerWriteKey:  hbhKeyA,
+		ClientWriteSalt: hbhSalA,
+		ServerWriteSalt: hbhSalA,
+	}
+	keyB := keyA
+	keyB.ClientWriteKey, keyB.ServerWriteKey = hbhKeyB, hbhKeyB
+	keyB.ClientWriteSalt, keyB.ServerWriteSalt = hbhSalB, hbhSalB
+
+	var conns []*net.UDPConn
+	for i, keys := range []HBHKeys{keyA, keyB} {
+		reg := testRegistration(i)
+		mdd.AdmitClient(reg)
+		conn := connectTestClient(t, serverAddr, reg, true)
+		conns = append(conns, conn)
+
+		assocID, _ := mdd.lookupAssoc(conn.LocalAddr().(*net.UDPAddr))
+		err := mdd.SetKeys(assocID, keys)
+		assert.NotError(t, err, "Failed to set keys")
+	}
+	return conns
+}
+
+func TestMDDDoubleForwarding(t *testing.T) {
+	mdd, serverAddr := newTestMDD(t)
+	defer mdd.Stop()
+
+	mdd.SetExtensionID(ExtensionAudioLevel, 1)
+
+	conns := connectKeyedClients(t, mdd, serverAddr)
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+
+	// Loud enough (-10 dBov) to make the sender a speaker
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	header[len(rtpHeaderBase)+5] = 0x8a
+	msg, inner := doubleProtect(t, header, hbhKeyA, hbhSalA)
+	_, err := conns[0].Write(msg)
+	assert.NotError(t, err, "Error sending SRTP")
+
+	buf := make([]byte, 2048)
+	conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conns[1].Read(buf)
+	assert.NotError(t, err, "SRTP packet not forwarded")
+
+	srtp, field, err := splitEKTField(buf[:n])
+	assert.NotError(t, err, "Forwarded packet has no EKT field")
+	assert.True(t, !field.full, "Wrong EKT field forwarded")
+
+	rcv, _ := newSRTPContext(hbhKeyB, hbhSalB)
+	pkt, err := rcv.unprotectHBH(srtp)
+	assert.NotError(t, err, "Forwarded packet not protected with receiver's key")
+	assert.BytesEqual(t, pkt.inner, inner, "Inner ciphertext changed by MD")
+}
+
+func TestMDDAudioSlots(t *testing.T) {
+	mdd := NewMDD()
+	mdd.SFU = NewSFU([]int8{109, 111})
+	mdd.KD = nullKD{}
+	serverAddr := listenTestMDD(t, mdd)
+	defer mdd.Stop()
+
+	mdd.SetExtensionID(ExtensionAudioLevel, 1)
+
+	conns := connectKeyedClients(t, mdd, serverAddr)
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+
+	packet := func(ssrc uint32, seq uint16, level byte) []byte {
+		header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+		header[2], header[3] = byte(seq>>8), byte(seq)
+		putUint32(header[8:], ssrc)
+		header[len(rtpHeaderBase)+5] = level
+		return header
+	}
+
+	// Read the next SRTP packet, skipping RTCP from the MD
+	buf := make([]byte, 2048)
+	readSRTP := func(conn *net.UDPConn, timeout time.Duration) ([]byte, error) {
+		for {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			if packetClass(buf[:n]) == packetClassSRTP {
+				return buf[:n], nil
+			}
+		}
+	}
+
+	// A client too quiet (-42 dBov) to be a speaker isn't forwarded
+	msg, _ := doubleProtect(t, packet(0x0a, 1, 0xaa), hbhKeyA, hbhSalA)
+	conns[0].Write(msg)
+	_, err := readSRTP(conns[1], 200*time.Millisecond)
+	assert.True(t, err != nil, "Non-speaker audio forwarded")
+
+	// With B the active speaker, A takes the second slot...
+	msg, _ = doubleProtect(t, packet(0x0b, 1, 0x8a), hbhKeyB, hbhSalB)
+	conns[1].Write(msg)
+	_, err = readSRTP(conns[0], time.Second)
+	assert.NotError(t, err, "Speaker audio not forwarded")
+
+	msg, _ = doubleProtect(t, packet(0x0a, 2, 0x8a), hbhKeyA, hbhSalA)
+	conns[0].Write(msg)
+	srtp, err := readSRTP(conns[1], time.Second)
+	assert.NotError(t, err, "Speaker audio not forwarded")
+
+	// ... and goes out on that slot's PT, with the original in the OHB
+	srtp, _, err = splitEKTField(srtp)
+	assert.NotError(t, err, "Forwarded packet has no EKT field")
+	rcv, _ := newSRTPContext(hbhKeyB, hbhSalB)
+	pkt, err := rcv.unprotectHBH(srtp)
+	assert.NotError(t, err, "Forwarded packet not protected with receiver's key")
+	assert.Equal(t, pkt.hdr.pt, uint8(111), "Wrong PT for audio slot")
+	assert.True(t, pkt.ohb.hasPT && pkt.ohb.pt == 109, "Original PT not in OHB")
+}
+
+func TestMDDReplay(t *testing.T) {
+	mdd, serverAddr := newTestMDD(t)
+	defer mdd.Stop()
+
+	mdd.SetExtensionID(ExtensionAudioLevel, 1)
+
+	conns := connectKeyedClients(t, mdd, serverAddr)
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	header[len(rtpHeaderBase)+5] = 0x8a
+	msg, _ := doubleProtect(t, header, hbhKeyA, hbhSalA)
+	conns[0].Write(msg)
+
+	buf := make([]byte, 2048)
+	conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conns[1].Read(buf)
+	assert.NotError(t, err, "SRTP packet not forwarded")
+
+	// The same packet again is dropped, rather than forwarded to everyone
+	conns[0].Write(msg)
+	for {
+		conns[1].SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conns[1].Read(buf)
+		if err != nil {
+			break
+		}
+		assert.True(t, packetClass(buf[:n]) != packetClassSRTP, "Replayed packet forwarded")
+	}
+}
+
+// Read the next compound RTCP packet from the MD, skipping its periodic
+// reports
+func readRTCP(t *testing.T, conn *net.UDPConn, ctx *srtcpContext, message string) []rtcpPacket {
+	buf := make([]byte, 2048)
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		assert.NotError(t, err, message)
+
+		plaintext, err := ctx.unprotect(buf[:n])
+		if err != nil {
+			// Not RTCP
+			continue
+		}
+
+		pkts, err := splitRTCP(plaintext)
+		assert.NotError(t, err, "Malformed RTCP from MD")
+		assert.Equal(t, pkts[0].pt(), uint8(rtcpTypeRR), "Compound RTCP does not start with an RR")
+		if len(pkts) > 1 {
+			return pkts[1:]
+		}
+	}
+}
+
+func TestMDDRTCPRouting(t *testing.T) {
+	mdd, serverAddr := newTestMDD(t)
+	defer mdd.Stop()
+
+	mdd.SetExtensionID(ExtensionAudioLevel, 1)
+
+	conns := connectKeyedClients(t, mdd, serverAddr)
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+
+	sendA, _ := newSRTCPContext(hbhKeyA, hbhSalA)
+	recvA, _ := newSRTCPContext(hbhKeyA, hbhSalA)
+	sendB, _ := newSRTCPContext(hbhKeyB, hbhSalB)
+	recvB, _ := newSRTCPContext(hbhKeyB, hbhSalB)
+
+	// A sends media, so the MD knows that A owns its SSRC
+	ssrcA := readUint32(rtpHeaderBase[8:])
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	header[len(rtpHeaderBase)+5] = 0x8a
+	msg, _ := doubleProtect(t, header, hbhKeyA, hbhSalA)
+	conns[0].Write(msg)
+
+	buf := make([]byte, 2048)
+	conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conns[1].Read(buf)
+	assert.NotError(t, err, "SRTP packet not forwarded")
+
+	// B's report is terminated; its PLI goes to A
+	rr := newReceiverReport(0x0b0b0b0b, []reportBlock{{ssrc: ssrcA}})
+	pli := newRTCPPacket(rtcpFmtPLI, rtcpTypePSFB, make([]byte, rtcpFeedbackSize))
+	putUint32(pli[4:], 0x0b0b0b0b)
+	putUint32(pli[8:], ssrcA)
+	conns[1].Write(sendB.protect(joinRTCP([]rtcpPacket{rr, pli})))
+
+	pkts := readRTCP(t, conns[0], recvA, "PLI not forwarded")
+	assert.Equal(t, len(pkts), 1, "Wrong number of RTCP packets forwarded")
+	assert.BytesEqual(t, pkts[0], pli, "Wrong PLI forwarded")
+
+	// A's sender report goes to B without its report blocks
+	sr := append(rtcpPacket{}, rtcpSR...)
+	putUint32(sr[4:], ssrcA)
+	conns[0].Write(sendA.protect(sr))
+
+	pkts = readRTCP(t, conns[1], recvB, "SR not forwarded")
+	assert.Equal(t, len(pkts), 1, "Wrong number of RTCP packets forwarded")
+	assert.Equal(t, pkts[0].pt(), uint8(rtcpTypeSR), "Wrong RTCP packet forwarded")
+	assert.Equal(t, pkts[0].count(), uint8(0), "Report blocks forwarded")
+	assert.Equal(t, pkts[0].ssrc(), ssrcA, "Wrong sender SSRC")
+
+	// B can't say BYE for A's source
+	bye := newRTCPPacket(1, rtcpTypeBYE, make([]byte, rtcpHeaderSize))
+	putUint32(bye[4:], ssrcA)
+	conns[1].Write(sendB.protect(bye))
+
+	// A saying BYE for its only source removes it
+	conns[0].Write(sendA.protect(bye))
+	pkts = readRTCP(t, conns[1], recvB, "BYE not forwarded")
+	assert.BytesEqual(t, pkts[0], bye, "Wrong BYE forwarded")
+
+	// The client is removed just after the BYE is sent on
+	count := 0
+	for i := 0; i < 100; i += 1 {
+		mdd.mu.Lock()
+		count = len(mdd.clients)
+		mdd.mu.Unlock()
+		if count == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, count, 1, "Client not removed after BYE")
+}
+
+func TestPacketClass(t *testing.T) {
+	for _, pt := range []byte{rtcpTypeSR, rtcpTypeRR, rtcpTypeSDES, rtcpTypeBYE, rtcpTypeRTPFB, rtcpTypePSFB} {
+		assert.Equal(t, packetClass([]byte{0x80, pt}), packetClassSRTCP, "RTCP not recognized")
+	}
+
+	// Audio and video PTs, with and without the marker bit
+	for _, b := range []byte{0x6d, 0xed, 0x60, 0xe0} {
+		assert.Equal(t, packetClass([]byte{0x80, b}), packetClassSRTP, "RTP not recognized")
+	}
+
+	assert.Equal(t, packetClass([]byte{0x80}), packetClassSRTP, "Short packet misclassified")
+}
+
+// A video packet from the test SSRC 0x0b0c0d0e, with frame marking (ID=2)
+func videoHeader(seq uint16, marking byte) []byte {
+	return []byte{
+		0x90, 0x60, byte(seq >> 8), byte(seq), 0x00, 0x00, 0x00, byte(seq), 0x0b, 0x0c, 0x0d, 0x0e,
+		0xbe, 0xde, 0x00, 0x01,
+		0x20, marking, 0x00, 0x00,
+	}
+}
+
+func TestMDDKeyframeOnSwitch(t *testing.T) {
+	mdd, serverAddr := newTestMDD(t)
+	defer mdd.Stop()
+
+	mdd.SetExtensionID(ExtensionAudioLevel, 1)
+	mdd.SetExtensionID(ExtensionFrameMarking, 2)
+
+	conns := connectKeyedClients(t, mdd, serverAddr)
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+
+	// A becomes the active speaker
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	header[len(rtpHeaderBase)+5] = 0x8a
+	msg, _ := doubleProtect(t, header, hbhKeyA, hbhSalA)
+	conns[0].Write(msg)
+
+	buf := make([]byte, 2048)
+	conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conns[1].Read(buf)
+	assert.NotError(t, err, "Audio not forwarded")
+
+	// B only gets A's video from the keyframe on
+	delta1, _ := doubleProtect(t, videoHeader(1, 0xc0), hbhKeyA, hbhSalA)
+	key, keyInner := doubleProtect(t, videoHeader(2, 0xe0), hbhKeyA, hbhSalA)
+	delta2, delta2Inner := doubleProtect(t, videoHeader(3, 0xc0), hbhKeyA, hbhSalA)
+	for _, msg := range [][]byte{delta1, key, delta2} {
+		conns[0].Write(msg)
+	}
+
+	rcv, _ := newSRTPContext(hbhKeyB, hbhSalB)
+	for _, inner := range [][]byte{keyInner, delta2Inner} {
+		conns[1].SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conns[1].Read(buf)
+		assert.NotError(t, err, "Video not forwarded")
+
+		srtp, _, _ := splitEKTField(buf[:n])
+		pkt, err := rcv.unprotectHBH(srtp)
+		assert.NotError(t, err, "Failed to decrypt video")
+		assert.BytesEqual(t, pkt.inner, inner, "Wrong video packet forwarded")
+	}
+
+	// A was asked for a keyframe
+	recvA, _ := newSRTCPContext(hbhKeyA, hbhSalA)
+	pkts := readRTCP(t, conns[0], recvA, "No keyframe request")
+	assert.Equal(t, len(pkts), 1, "Wrong number of RTCP packets")
+	assert.Equal(t, pkts[0].pt(), uint8(rtcpTypePSFB), "Wrong RTCP packet type")
+	assert.Equal(t, pkts[0].count(), uint8(rtcpFmtPLI), "Not a PLI")
+	assert.Equal(t, pkts[0].ssrc(), mdd.ssrc, "PLI not from the MD")
+	assert.Equal(t, pkts[0].feedbackTargets()[0], uint32(0x0b0c0d0e), "PLI for wrong SSRC")
+}
+
+func TestMDDKeyframeRateLimit(t *testing.T) {
+	mdd := NewMDD()
+	now := time.Now()
+	src := mediaSource{assocID: 1, ssrc: 0x0b0c0d0e}
+
+	assert.True(t, mdd.requestKeyframe(src, now), "First keyframe request not sent")
+	assert.True(t, !mdd.requestKeyframe(src, now.Add(mdd.keyframeInterval/2)), "Keyframe request not rate-limited")
+	assert.True(t, mdd.requestKeyframe(mediaSource{assocID: 2, ssrc: 0x0b0c0d0e}, now), "Rate limit shared between sources")
+	assert.True(t, mdd.requestKeyframe(src, now.Add(mdd.keyframeInterval)), "Keyframe request not repeated")
+}
+
+func TestMDDNACKCache(t *testing.T) {
+	mdd, serverAddr := newTestMDD(t)
+	defer mdd.Stop()
+
+	mdd.SetExtensionID(ExtensionAudioLevel, 1)
+
+	conns := connectKeyedClients(t, mdd, serverAddr)
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	header[len(rtpHeaderBase)+5] = 0x8a
+	msg, _ := doubleProtect(t, header, hbhKeyA, hbhSalA)
+	conns[0].Write(msg)
+
+	buf := make([]byte, 2048)
+	conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conns[1].Read(buf)
+	assert.NotError(t, err, "SRTP packet not forwarded")
+	forwarded := append([]byte{}, buf[:n]...)
+
+	// B asks for the packet it got, and for one the MD never saw
+	ssrcA := readUint32(rtpHeaderBase[8:])
+	seq := uint16(rtpHeaderBase[2])<<8 | uint16(rtpHeaderBase[3])
+	sendB, _ := newSRTCPContext(hbhKeyB, hbhSalB)
+	nack := newNACK(0x0b0b0b0b, ssrcA, []uint16{seq, seq + 3})
+	conns[1].Write(sendB.protect(nack))
+
+	// The MD resends the cached packet itself...
+	conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	n, err = conns[1].Read(buf)
+	assert.NotError(t, err, "Packet not retransmitted")
+	assert.BytesEqual(t, buf[:n], forwarded, "Retransmission differs from original")
+
+	// ... and asks the sender for the rest
+	recvA, _ := newSRTCPContext(hbhKeyA, hbhSalA)
+	pkts := readRTCP(t, conns[0], recvA, "NACK not forwarded")
+	assert.Equal(t, len(pkts), 1, "Wrong number of RTCP packets")
+	pids := pkts[0].nackPIDs()
+	assert.Equal(t, len(pids), 1, "Cached packet NACKed upstream")
+	assert.Equal(t, pids[0], seq+3, "Wrong packet NACKed upstream")
+}
+
+func TestMDDBandwidthEstimation(t *testing.T) {
+	mdd, serverAddr := newTestMDD(t)
+	defer mdd.Stop()
+
+	mdd.SetExtensionID(ExtensionAudioLevel, 1)
+	mdd.SetExtensionID(ExtensionFrameMarking, 2)
+
+	conns := connectKeyedClients(t, mdd, serverAddr)
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+
+	// A becomes the active speaker, and sends video to B
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	header[len(rtpHeaderBase)+5] = 0x8a
+	audio, _ := doubleProtect(t, header, hbhKeyA, hbhSalA)
+	video, _ := doubleProtect(t, videoHeader(1, 0xe0), hbhKeyA, hbhSalA)
+
+	buf := make([]byte, 2048)
+	for _, msg := range [][]byte{audio, video} {
+		conns[0].Write(msg)
+		conns[1].SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conns[1].Read(buf)
+		assert.NotError(t, err, "SRTP packet not forwarded")
+	}
+
+	// B's REMB is consumed by the MD
+	assocB, _ := mdd.lookupAssoc(conns[1].LocalAddr().(*net.UDPAddr))
+	sendB, _ := newSRTCPContext(hbhKeyB, hbhSalB)
+	conns[1].Write(sendB.protect(newREMB(0x0b0b0b0b, 500000, []uint32{0x0b0c0d0e})))
+
+	var bps uint64
+	ok := false
+	for i := 0; i < 100 && !ok; i += 1 {
+		time.Sleep(10 * time.Millisecond)
+		bps, ok = mdd.SFU.Bandwidth(ClientID(assocB))
+	}
+	assert.True(t, ok, "Bandwidth estimate not passed to SFU")
+	assert.Equal(t, bps, uint64(500000), "Wrong bandwidth estimate")
+
+	// A hears about it along with the MD's report
+	mdd.sendReceiverReports(time.Now())
+
+	recvA, _ := newSRTCPContext(hbhKeyA, hbhSalA)
+	pkts := readRTCP(t, conns[0], recvA, "No REMB sent")
+	assert.Equal(t, len(pkts), 1, "Wrong number of RTCP packets")
+	assert.True(t, pkts[0].isREMB(), "Not a REMB")
+	assert.Equal(t, pkts[0].ssrc(), mdd.ssrc, "REMB not from the MD")
+	assert.Equal(t, pkts[0].rembBitrate(), uint64(500000)>>1<<1, "Wrong REMB bitrate")
+	targets := pkts[0].feedbackTargets()
+	assert.Equal(t, len(targets), 1, "Wrong REMB targets")
+	assert.Equal(t, targets[0], uint32(0x0b0c0d0e), "REMB for wrong SSRC")
+}
+
+func TestMDDTemporalDropping(t *testing.T) {
+	// No periodic measurements to change the SFU's mind
+	mdd := NewMDD()
+	mdd.SFU = NewSFU([]int8{109, 109})
+	mdd.KD = nullKD{}
+	mdd.rtcpInterval = time.Hour
+	serverAddr := listenTestMDD(t, mdd)
+	defer mdd.Stop()
+
+	mdd.SetExtensionID(ExtensionAudioLevel, 1)
+	mdd.SetExtensionID(ExtensionFrameMarking, 2)
+
+	conns := connectKeyedClients(t, mdd, serverAddr)
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	header[len(rtpHeaderBase)+5] = 0x8a
+	audio, _ := doubleProtect(t, header, hbhKeyA, hbhSalA)
+	conns[0].Write(audio)
+
+	buf := make([]byte, 2048)
+	conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conns[1].Read(buf)
+	assert.NotError(t, err, "Audio not forwarded")
+
+	// B can only take the base layer of A's video
+	assocA, _ := mdd.lookupAssoc(conns[0].LocalAddr().(*net.UDPAddr))
+	assocB, _ := mdd.lookupAssoc(conns[1].LocalAddr().(*net.UDPAddr))
+	mdd.SFU.SetLayers(ClientID(assocA), []uint64{400000})
+	mdd.SFU.SetBandwidth(ClientID(assocB), 100000)
+
+	// L1T3, one packet per frame: TID 0 (keyframe), 2, 1, 2, 0
+	var base [][]byte
+	for i, marking := range []byte{0xe0, 0xc2, 0xc1, 0xc2, 0xc0} {
+		msg, inner := doubleProtect(t, videoHeader(uint16(i+1), marking), hbhKeyA, hbhSalA)
+		conns[0].Write(msg)
+		if marking&0x07 == 0 {
+			base = append(base, inner)
+		}
+	}
+
+	rcv, _ := newSRTPContext(hbhKeyB, hbhSalB)
+	for i, seq := range []uint16{1, 5} {
+		conns[1].SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conns[1].Read(buf)
+		assert.NotError(t, err, "Base layer not forwarded")
+
+		srtp, _, _ := splitEKTField(buf[:n])
+		pkt, err := rcv.unprotectHBH(srtp)
+		assert.NotError(t, err, "Failed to decrypt video")
+		assert.BytesEqual(t, pkt.inner, base[i], "Wrong video packet forwarded")
+		assert.Equal(t, pkt.hdr.seq, uint16(i+1), "Sequence numbers not continuous")
+
+		_, orig := originalHeader(pkt)
+		assert.Equal(t, orig.seq, seq, "Sender's sequence number not in OHB")
+	}
+}
@@ -0,0 +1,104 @@
+package percy
+
+import (
+	"log"
+)
+
+// The MD keeps the last few packets it has forwarded to each receiver from
+// each source, so that it can answer NACKs itself instead of passing them
+// all the way back to the sender.  This mostly helps receivers on lossy
+// last-mile links, whose losses would otherwise cost the sender upstream
+// bandwidth.
+//
+// Packets are cached as they were sent to the receiver, with the outer
+// layer removed.  A retransmission is the same packet protected again with
+// the same key and index, so the receiver can't tell it from the original.
+// The inner (E2E) ciphertext is shared between receivers, so a cache entry
+// only costs a header.
+//
+// https://tools.ietf.org/html/rfc4585#section-6.2.1
+
+const nackCacheSize = 512
+
+// A ring buffer of packets, indexed by sequence number
+type packetCache struct {
+	pkts []*hbhPacket
+}
+
+func newPacketCache() *packetCache {
+	return &packetCache{pkts: make([]*hbhPacket, nackCacheSize)}
+}
+
+func (cache *packetCache) put(pkt *hbhPacket) {
+	cache.pkts[int(pkt.hdr.seq)%nackCacheSize] = pkt
+}
+
+func (cache *packetCache) get(seq uint16) *hbhPacket {
+	pkt := cache.pkts[int(seq)%nackCacheSize]
+	if pkt == nil || pkt.hdr.seq != seq {
+		return nil
+	}
+	return pkt
+}
+
+// Remember a packet sent to this client
+func (client *mddClient) cache(src mediaSource, pkt *hbhPacket) {
+	if client.sent == nil {
+		client.sent = map[mediaSource]*packetCache{}
+	}
+
+	cache, ok := client.sent[src]
+	if !ok {
+		cache = newPacketCache()
+		client.sent[src] = cache
+	}
+	cache.put(pkt)
+}
+
+// Resend whatever a NACK asks for that is still in the cache.  Returns a
+// NACK for the rest, which has to go to the sender, or nil if there is
+// nothing left.
+func (mdd *MDD) answerNACK(assocID AssociationID, client *mddClient, pkt rtcpPacket) rtcpPacket {
+	targets := pkt.feedbackTargets()
+	if len(targets) == 0 {
+		return pkt
+	}
+
+	media := targets[0]
+	owner, ok := mdd.ssrcOwners[media]
+	if !ok {
+		return pkt
+	}
+
+	src := mediaSource{assocID: owner, ssrc: media}
+	cache, ok := client.sent[src]
+	if !ok {
+		return pkt
+	}
+
+	ctx, ok := mdd.hbhSend[assocID]
+	if !ok {
+		return pkt
+	}
+
+	var missing []uint16
+	for _, seq := range pkt.nackPIDs() {
+		cached := cache.get(seq)
+		if cached == nil {
+			missing = append(missing, seq)
+			continue
+		}
+
+		msg := ctx.protectHBH(cached)
+		msg = append(msg, mdd.ekt.forward(assocID, src, shortEKTField).marshal()...)
+		_, err := mdd.conn.WriteToUDP(msg, client.addr)
+		if err != nil {
+			log.Printf("Error retransmitting packet to [%v] [%v]", assocID, err)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+	return newNACK(pkt.ssrc(), media, missing)
+}
@@ -0,0 +1,27 @@
+package percy
+
+import (
+	"testing"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+func TestPacketCache(t *testing.T) {
+	cache := newPacketCache()
+	pkt := func(seq uint16) *hbhPacket {
+		return &hbhPacket{hdr: &rtpHeader{seq: seq}}
+	}
+
+	first := pkt(0xffff)
+	cache.put(first)
+	assert.True(t, cache.get(0xffff) == first, "Cached packet not found")
+	assert.True(t, cache.get(0xfffe) == nil, "Found a packet that was never cached")
+
+	// A packet a whole cache later takes the slot
+	seq := uint16(0xffff)
+	seq += nackCacheSize
+	later := pkt(seq)
+	cache.put(later)
+	assert.True(t, cache.get(0xffff) == nil, "Found a packet that was overwritten")
+	assert.True(t, cache.get(seq) == later, "Cached packet not found")
+}
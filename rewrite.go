@@ -0,0 +1,203 @@
+package percy
+
+// Per-receiver header rewriting.  As the SFU switches speakers, each
+// receiver sees sources come and go from its audio slots and its video
+// views.  The MD smooths this over for the receiver's jitter buffer:
+//
+// * A source that starts being forwarded in an audio slot has its first
+//   packet marked as the start of a talkspurt.
+//
+// * Sequence numbers are rewritten per receiver so that each stream the
+//   receiver sees is continuous, without a gap for the time it was not
+//   being forwarded.  The MD counts the packets it gets from each source,
+//   so it can tell packets it chose not to forward from ones lost on the
+//   way in; gaps from loss are preserved, so that NACKs still make sense.
+//   Packets that arrive late, from before the stream resumed, are dropped:
+//   their place has been given to later packets, and sending one would
+//   reuse a sequence number (and so a GCM nonce) with different contents.
+//
+// PERC limits what can be done here.  The inner (E2E) layer authenticates
+// the sender's whole header, and the OHB can only restore the PT, SEQ and
+// marker bit.  So unlike a conventional SFU, the MD can't move a new speaker
+// onto a stable SSRC or rewrite timestamps; receivers see one SSRC per
+// sender, with the sender's own timestamps, and rely on the marker bit to
+// resynchronize.
+//
+// https://tools.ietf.org/html/rfc8723#section-4
+
+// How many resumes a seqRewriter remembers, for translating NACKs
+const seqResumeHistory = 16
+
+// Where a stream resumed, and the offset from then on
+type seqResume struct {
+	out    uint64 // the first sequence number sent after the resume, extended
+	offset uint16
+}
+
+// Sequence number state for one source as seen by one receiver
+type seqRewriter struct {
+	offset    uint16
+	ext       uint64 // the highest sender's sequence number seen, extended
+	base      uint64 // the extended sequence number where the offset starts
+	lastOut   uint64 // the highest sequence number sent, extended
+	lastCount uint64
+	resumes   []seqResume // oldest first
+}
+
+func newSeqRewriter(seq uint16, count uint64) *seqRewriter {
+	ext := 1<<16 + uint64(seq)
+	return &seqRewriter{
+		ext:       ext,
+		base:      ext,
+		lastOut:   ext - 1,
+		lastCount: count - 1,
+		resumes:   []seqResume{{out: ext}},
+	}
+}
+
+// Rewrite the sequence number of the count'th packet the MD has received
+// from the source.  Returns false if the packet can't be sent, because it
+// is from before the point the stream last resumed.
+func (rw *seqRewriter) rewrite(seq uint16, count uint64) (uint16, bool) {
+	resume := count != rw.lastCount+1
+	rw.lastCount = count
+	if resume {
+		rw.offset = uint16(rw.lastOut+1) - seq
+
+		// The sender's sequence number could have moved any distance
+		// while the stream wasn't forwarded, so extend it afresh
+		rw.ext = (rw.ext+1<<17)&^0xffff | uint64(seq)
+		rw.base = rw.ext
+
+		rw.resumes = append(rw.resumes, seqResume{out: rw.lastOut + 1, offset: rw.offset})
+		if len(rw.resumes) > seqResumeHistory {
+			rw.resumes = rw.resumes[1:]
+		}
+	}
+
+	ext := uint64(int64(rw.ext) + int64(int16(seq-uint16(rw.ext))))
+	if ext < rw.base {
+		return 0, false
+	}
+	if ext > rw.ext {
+		rw.ext = ext
+	}
+
+	out := seq + rw.offset
+	if ext := rw.extendOut(out); ext > rw.lastOut {
+		rw.lastOut = ext
+	}
+	return out, true
+}
+
+// Extend a sequence number sent to the receiver, relative to the highest
+func (rw *seqRewriter) extendOut(out uint16) uint64 {
+	return uint64(int64(rw.lastOut) + int64(int16(out-uint16(rw.lastOut))))
+}
+
+// Translate a sequence number sent to the receiver back to the sender's,
+// using the offset in force when it was sent.  Returns false if that is
+// too long ago to know.
+func (rw *seqRewriter) original(out uint16) (uint16, bool) {
+	ext := rw.extendOut(out)
+	for i := len(rw.resumes) - 1; i >= 0; i -= 1 {
+		if ext >= rw.resumes[i].out {
+			return out - rw.resumes[i].offset, true
+		}
+	}
+	return 0, false
+}
+
+// Adjust the header of the count'th packet from a source for this client.
+// The SFU says which audio slot (and PT) the packet goes in, or zero for
+// video.
+// The packet is only copied if something changes; the OHB keeps track of
+// the sender's values.  Returns nil if the packet can't be sent to this
+// client.
+func (client *mddClient) rewrite(pkt *hbhPacket, src mediaSource, count uint64, dest Destination) *hbhPacket {
+	out := pkt
+	change := func() {
+		if out == pkt {
+			out = pkt.clone()
+		}
+	}
+
+	if client.slots == nil {
+		client.slots = map[int]AssociationID{}
+	}
+	if client.streams == nil {
+		client.streams = map[mediaSource]*seqRewriter{}
+	}
+
+	stream, ok := client.streams[src]
+	if !ok {
+		stream = newSeqRewriter(pkt.hdr.seq, count)
+		client.streams[src] = stream
+	}
+
+	seq, ok := stream.rewrite(pkt.hdr.seq, count)
+	if !ok {
+		return nil
+	}
+
+	if dest.pt != 0 {
+		// Has this slot just switched to this sender?
+		last, known := client.slots[dest.slot]
+		switched := known && last != src.assocID
+		client.slots[dest.slot] = src.assocID
+
+		if uint8(dest.pt) != pkt.hdr.pt {
+			change()
+			out.setPT(uint8(dest.pt))
+		}
+
+		// The marker bit means something else for video (end of frame),
+		// so only audio gets it
+		if switched && !pkt.hdr.marker {
+			change()
+			out.setMarker(true)
+		}
+	}
+
+	if seq != pkt.hdr.seq {
+		change()
+		out.setSeq(seq)
+	}
+
+	return out
+}
+
+// Forget about a source that has gone away
+func (client *mddClient) removeSource(assocID AssociationID) {
+	for src := range client.streams {
+		if src.assocID == assocID {
+			delete(client.streams, src)
+		}
+	}
+
+	delete(client.layers, assocID)
+
+	for src := range client.temporal {
+		if src.assocID == assocID {
+			delete(client.temporal, src)
+		}
+	}
+
+	for src := range client.sent {
+		if src.assocID == assocID {
+			delete(client.sent, src)
+		}
+	}
+
+	for src := range client.decoding {
+		if src.assocID == assocID {
+			delete(client.decoding, src)
+		}
+	}
+
+	for slot, sender := range client.slots {
+		if sender == assocID {
+			delete(client.slots, slot)
+		}
+	}
+}
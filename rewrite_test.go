@@ -0,0 +1,175 @@
+package percy
+
+import (
+	"testing"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+func TestSeqRewriter(t *testing.T) {
+	rewrite := func(rw *seqRewriter, seq uint16, count uint64) uint16 {
+		out, ok := rw.rewrite(seq, count)
+		assert.True(t, ok, "Packet dropped")
+		return out
+	}
+
+	// Packets forwarded back to back keep their sequence numbers, gaps
+	// from loss included
+	rw := newSeqRewriter(0xfffe, 1)
+	assert.Equal(t, rewrite(rw, 0xfffe, 1), uint16(0xfffe), "First packet rewritten")
+	assert.Equal(t, rewrite(rw, 0x0001, 2), uint16(0x0001), "Loss gap not preserved")
+
+	// Packets the MD received but didn't forward are squeezed out
+	assert.Equal(t, rewrite(rw, 0x0100, 10), uint16(0x0002), "Forwarding gap not removed")
+	assert.Equal(t, rewrite(rw, 0x0101, 11), uint16(0x0003), "Offset not kept")
+
+	// Reordered packets keep their place
+	assert.Equal(t, rewrite(rw, 0x0104, 12), uint16(0x0006), "Loss gap after resume not preserved")
+	assert.Equal(t, rewrite(rw, 0x0102, 13), uint16(0x0004), "Reordered packet misplaced")
+	assert.Equal(t, uint16(rw.lastOut), uint16(0x0006), "Reordered packet moved the high-water mark")
+}
+
+func TestSeqRewriterLateAfterResume(t *testing.T) {
+	// 10 is sent, 11 is not, 13 resumes the stream, then 12 arrives late
+	rw := newSeqRewriter(10, 1)
+	sent := map[uint16]bool{}
+	for _, p := range []struct {
+		seq     uint16
+		count   uint64
+		forward bool
+	}{{10, 1, true}, {11, 2, false}, {13, 3, true}, {12, 4, true}, {14, 5, true}} {
+		if !p.forward {
+			continue
+		}
+
+		out, ok := rw.rewrite(p.seq, p.count)
+		if !ok {
+			assert.Equal(t, p.seq, uint16(12), "Wrong packet dropped")
+			continue
+		}
+		assert.True(t, !sent[out], "Output sequence number repeated")
+		sent[out] = true
+	}
+	assert.Equal(t, len(sent), 3, "Wrong number of packets sent")
+}
+
+func TestSeqRewriterLongRun(t *testing.T) {
+	// A stream that never pauses is never dropped, however long it runs
+	rw := newSeqRewriter(0xfff0, 1)
+	for i := 0; i < 0x18000; i += 1 {
+		seq := uint16(0xfff0 + i)
+		out, ok := rw.rewrite(seq, uint64(i+1))
+		if !ok || out != seq {
+			t.Fatalf("Packet %d (seq %04x) dropped or rewritten", i+1, seq)
+		}
+	}
+
+	// ... and a late packet in it is still sent
+	out, ok := rw.rewrite(0x7fed, 0x18001)
+	assert.True(t, ok && out == 0x7fed, "Reordered packet dropped")
+}
+
+func TestSeqRewriterOriginal(t *testing.T) {
+	rw := newSeqRewriter(10, 1)
+	rw.rewrite(10, 1)
+	rw.rewrite(11, 2)
+	rw.rewrite(20, 12) // resumes as 12
+	rw.rewrite(21, 13)
+
+	for _, c := range []struct{ out, seq uint16 }{{10, 10}, {11, 11}, {12, 20}, {13, 21}, {15, 23}} {
+		seq, ok := rw.original(c.out)
+		assert.True(t, ok, "Sequence number not translated")
+		assert.Equal(t, seq, c.seq, "Wrong offset used for sequence number")
+	}
+
+	_, ok := rw.original(9)
+	assert.True(t, !ok, "Sequence number from before the stream translated")
+
+	// The offset still applies long after the resume
+	for i := 0; i < 0x9000; i += 1 {
+		rw.rewrite(uint16(22+i), uint64(14+i))
+	}
+	seq, ok := rw.original(uint16(14 + 0x8ffe))
+	assert.True(t, ok && seq == uint16(22+0x8ffe), "Old resume not used")
+}
+
+func TestRewriteStreams(t *testing.T) {
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	header[1] &^= 0x80
+	hdr, _ := parseRTPHeader(header)
+
+	packet := func(seq uint16) *hbhPacket {
+		pkt := &hbhPacket{header: append([]byte{}, header...), hdr: &rtpHeader{}}
+		*pkt.hdr = *hdr
+		pkt.setSeq(seq)
+		pkt.ohb = ohb{}
+		return pkt
+	}
+
+	client := &mddClient{}
+	srcA := mediaSource{assocID: 1, ssrc: 0x0a}
+	srcB := mediaSource{assocID: 2, ssrc: 0x0b}
+	audio := Destination{clientID: 3, pt: 109}
+	video := Destination{clientID: 3, pt: 0}
+
+	// A speaks, then B takes over the slot for a while, then A is back
+	out := client.rewrite(packet(100), srcA, 1, audio)
+	assert.True(t, !out.hdr.marker, "First packet in slot marked")
+	client.rewrite(packet(101), srcA, 2, audio)
+
+	out = client.rewrite(packet(500), srcB, 1, audio)
+	assert.True(t, out.hdr.marker, "Switch to B not marked")
+	assert.Equal(t, out.hdr.seq, uint16(500), "New source rewritten")
+
+	out = client.rewrite(packet(150), srcA, 50, audio)
+	assert.True(t, out.hdr.marker, "Switch back to A not marked")
+	assert.Equal(t, out.hdr.seq, uint16(102), "A's stream not continuous")
+	assert.True(t, out.ohb.hasSeq && out.ohb.seq == 150, "Original SEQ not in OHB")
+
+	// Video is switched the same way, but never marked
+	client.rewrite(packet(10), mediaSource{assocID: 1, ssrc: 0x1a}, 1, video)
+	out = client.rewrite(packet(20), mediaSource{assocID: 2, ssrc: 0x1b}, 1, video)
+	assert.True(t, !out.hdr.marker, "Video packet marked on switch")
+
+	client.removeSource(srcA.assocID)
+	_, ok := client.streams[srcA]
+	assert.True(t, !ok, "Removed source still has stream state")
+	_, ok = client.slots[audio.slot]
+	assert.True(t, !ok, "Removed source still has a slot")
+	_, ok = client.streams[srcB]
+	assert.True(t, ok, "Other source's stream state removed")
+}
+
+func TestRewriteSharedPT(t *testing.T) {
+	header := append(append([]byte{}, rtpHeaderBase...), oneByteExtension...)
+	header[1] &^= 0x80
+	hdr, _ := parseRTPHeader(header)
+
+	packet := func(seq uint16) *hbhPacket {
+		pkt := &hbhPacket{header: append([]byte{}, header...), hdr: &rtpHeader{}}
+		*pkt.hdr = *hdr
+		pkt.setSeq(seq)
+		pkt.ohb = ohb{}
+		return pkt
+	}
+
+	// Two speakers in slots with the same PT
+	client := &mddClient{}
+	srcA := mediaSource{assocID: 1, ssrc: 0x0a}
+	srcB := mediaSource{assocID: 2, ssrc: 0x0b}
+	active := Destination{clientID: 3, pt: 109, slot: 0}
+	previous := Destination{clientID: 3, pt: 109, slot: 1}
+
+	for i := uint16(0); i < 3; i += 1 {
+		out := client.rewrite(packet(100+i), srcA, uint64(1+i), active)
+		assert.True(t, !out.hdr.marker, "Marker set without a switch")
+		out = client.rewrite(packet(500+i), srcB, uint64(1+i), previous)
+		assert.True(t, !out.hdr.marker, "Marker set without a switch")
+	}
+
+	// Only the first packet after a switch is marked
+	out := client.rewrite(packet(503), srcB, 4, active)
+	assert.True(t, out.hdr.marker, "Switch not marked")
+	out = client.rewrite(packet(504), srcB, 5, active)
+	assert.True(t, !out.hdr.marker, "Marker set after the switch")
+}
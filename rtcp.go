@@ -0,0 +1,404 @@
+package percy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// RTCP is only protected hop-by-hop in PERC, so the MD can read and
+// rewrite it freely.  The MD terminates reception reports (and generates
+// its own), passes sender reports, SDES and BYE along to the rest of the
+// conference, and routes feedback to the sender of the media it is about.
+//
+// https://tools.ietf.org/html/rfc8723#section-3.2
+// https://tools.ietf.org/html/rfc3550#section-6
+
+const (
+	rtcpTypeSR    = 200
+	rtcpTypeRR    = 201
+	rtcpTypeSDES  = 202
+	rtcpTypeBYE   = 203
+	rtcpTypeRTPFB = 205
+	rtcpTypePSFB  = 206
+
+	// Feedback message types (FMT)
+	rtcpFmtNACK = 1  // RTPFB: https://tools.ietf.org/html/rfc4585#section-6.2.1
+	rtcpFmtPLI  = 1  // PSFB: https://tools.ietf.org/html/rfc4585#section-6.3.1
+	rtcpFmtFIR  = 4  // PSFB: https://tools.ietf.org/html/rfc5104#section-4.3.1
+	rtcpFmtAFB  = 15 // PSFB: https://tools.ietf.org/html/draft-alvestrand-rmcat-remb
+
+	rtcpHeaderSize      = 8 // including the sender SSRC
+	rtcpFeedbackSize    = 12
+	rtcpSenderInfoSize  = 20
+	rtcpReportBlockSize = 24
+	rtcpMaxCount        = 31
+)
+
+// One packet from a compound RTCP packet, including its header
+type rtcpPacket []byte
+
+func (pkt rtcpPacket) count() uint8 { return pkt[0] & 0x1f }
+func (pkt rtcpPacket) pt() uint8    { return pkt[1] }
+func (pkt rtcpPacket) ssrc() uint32 { return readUint32(pkt[4:]) }
+
+func splitRTCP(msg []byte) ([]rtcpPacket, error) {
+	var pkts []rtcpPacket
+	for len(msg) > 0 {
+		if len(msg) < 4 {
+			return nil, fmt.Errorf("RTCP packet too short [%d]", len(msg))
+		}
+
+		if msg[0]>>6 != 2 {
+			return nil, fmt.Errorf("Unsupported RTCP version [%d]", msg[0]>>6)
+		}
+
+		length := 4 * (int(msg[2])<<8 | int(msg[3]) + 1)
+		if length > len(msg) {
+			return nil, fmt.Errorf("RTCP packet overruns compound packet")
+		}
+
+		// Every packet type the MD handles has a sender SSRC
+		if length < rtcpHeaderSize {
+			return nil, fmt.Errorf("RTCP packet too short for SSRC [%d]", length)
+		}
+
+		pkts = append(pkts, rtcpPacket(msg[:length]))
+		msg = msg[length:]
+	}
+
+	if len(pkts) == 0 {
+		return nil, fmt.Errorf("Empty RTCP packet")
+	}
+	return pkts, nil
+}
+
+func joinRTCP(pkts []rtcpPacket) []byte {
+	var msg []byte
+	for _, pkt := range pkts {
+		msg = append(msg, pkt...)
+	}
+	return msg
+}
+
+func newRTCPPacket(count, pt uint8, body []byte) rtcpPacket {
+	length := len(body)/4 - 1
+	pkt := make(rtcpPacket, len(body))
+	copy(pkt, body)
+	pkt[0] = 0x80 | (count & 0x1f)
+	pkt[1] = pt
+	pkt[2] = byte(length >> 8)
+	pkt[3] = byte(length)
+	return pkt
+}
+
+func putUint32(data []byte, val uint32) {
+	data[0] = byte(val >> 24)
+	data[1] = byte(val >> 16)
+	data[2] = byte(val >> 8)
+	data[3] = byte(val)
+}
+
+// A sender report without its reception report blocks, which describe what
+// the sender received from the MD and so mean nothing to anyone else.
+// Profile-specific extensions go with the report blocks.
+func (pkt rtcpPacket) senderInfo() rtcpPacket {
+	size := rtcpHeaderSize + rtcpSenderInfoSize
+	if len(pkt) < size {
+		return nil
+	}
+	return newRTCPPacket(0, rtcpTypeSR, pkt[:size])
+}
+
+// The SSRCs that a BYE says are leaving
+func (pkt rtcpPacket) byeSSRCs() []uint32 {
+	var ssrcs []uint32
+	for i := 0; i < int(pkt.count()) && 4+4*(i+1) <= len(pkt); i += 1 {
+		ssrcs = append(ssrcs, readUint32(pkt[4+4*i:]))
+	}
+	return ssrcs
+}
+
+func (pkt rtcpPacket) isFeedback() bool {
+	return pkt.pt() == rtcpTypeRTPFB || pkt.pt() == rtcpTypePSFB
+}
+
+func (pkt rtcpPacket) isREMB() bool {
+	return pkt.pt() == rtcpTypePSFB && pkt.count() == rtcpFmtAFB &&
+		len(pkt) >= rtcpFeedbackSize+8 && string(pkt[12:16]) == "REMB"
+}
+
+// The media SSRCs a feedback message is about.  Most carry it in the
+// common header; FIR and REMB list them in the FCI.
+func (pkt rtcpPacket) feedbackTargets() []uint32 {
+	if len(pkt) < rtcpFeedbackSize {
+		return nil
+	}
+
+	switch {
+	case pkt.pt() == rtcpTypePSFB && pkt.count() == rtcpFmtFIR:
+		var ssrcs []uint32
+		for fci := pkt[rtcpFeedbackSize:]; len(fci) >= 8; fci = fci[8:] {
+			ssrcs = append(ssrcs, readUint32(fci))
+		}
+		return ssrcs
+
+	case pkt.isREMB():
+		// Unique identifier 'REMB' | Num SSRC | BR Exp | BR Mantissa | SSRCs
+		n := int(pkt[16])
+		var ssrcs []uint32
+		for i := 0; i < n && 20+4*(i+1) <= len(pkt); i += 1 {
+			ssrcs = append(ssrcs, readUint32(pkt[20+4*i:]))
+		}
+		return ssrcs
+
+	default:
+		return []uint32{readUint32(pkt[8:])}
+	}
+}
+
+// The bitrate in a REMB, in bits per second: a 6-bit exponent and an
+// 18-bit mantissa
+func (pkt rtcpPacket) rembBitrate() uint64 {
+	exp := pkt[17] >> 2
+	mantissa := uint64(pkt[17]&0x03)<<16 | uint64(pkt[18])<<8 | uint64(pkt[19])
+	return mantissa << exp
+}
+
+func newREMB(ssrc uint32, bitrate uint64, ssrcs []uint32) rtcpPacket {
+	if len(ssrcs) > 0xff {
+		ssrcs = ssrcs[:0xff]
+	}
+
+	var exp uint8
+	for bitrate >= 1<<18 {
+		bitrate >>= 1
+		exp += 1
+	}
+
+	body := make([]byte, rtcpFeedbackSize+8, rtcpFeedbackSize+8+4*len(ssrcs))
+	putUint32(body[4:], ssrc)
+	copy(body[12:], "REMB")
+	body[16] = byte(len(ssrcs))
+	body[17] = exp<<2 | byte(bitrate>>16)
+	body[18] = byte(bitrate >> 8)
+	body[19] = byte(bitrate)
+	for _, media := range ssrcs {
+		body = append(body, 0, 0, 0, 0)
+		putUint32(body[len(body)-4:], media)
+	}
+	return newRTCPPacket(rtcpFmtAFB, rtcpTypePSFB, body)
+}
+
+// The packet IDs a generic NACK asks for.  Each FCI entry is a PID and a
+// bitmask of the following 16 packets (BLP).
+func (pkt rtcpPacket) nackPIDs() []uint16 {
+	var pids []uint16
+	for fci := pkt[rtcpFeedbackSize:]; len(fci) >= 4; fci = fci[4:] {
+		pid := uint16(fci[0])<<8 | uint16(fci[1])
+		blp := uint16(fci[2])<<8 | uint16(fci[3])
+
+		pids = append(pids, pid)
+		for i := uint16(0); i < 16; i += 1 {
+			if blp&(1<<i) != 0 {
+				pids = append(pids, pid+i+1)
+			}
+		}
+	}
+	return pids
+}
+
+// A generic NACK for a list of packet IDs, in order
+func newNACK(ssrc, media uint32, pids []uint16) rtcpPacket {
+	body := make([]byte, rtcpFeedbackSize)
+	putUint32(body[4:], ssrc)
+	putUint32(body[8:], media)
+
+	for i := 0; i < len(pids); {
+		pid := pids[i]
+		var blp uint16
+		for i += 1; i < len(pids); i += 1 {
+			delta := pids[i] - pid
+			if delta == 0 || delta > 16 {
+				break
+			}
+			blp |= 1 << (delta - 1)
+		}
+
+		body = append(body, byte(pid>>8), byte(pid), byte(blp>>8), byte(blp))
+	}
+
+	return newRTCPPacket(rtcpFmtNACK, rtcpTypeRTPFB, body)
+}
+
+//////////
+
+// https://tools.ietf.org/html/rfc3550#section-6.4.1
+type reportBlock struct {
+	ssrc           uint32
+	fractionLost   uint8
+	cumulativeLost uint32 // 24 bits
+	highestSeq     uint32
+	jitter         uint32
+	lsr            uint32
+	dlsr           uint32
+}
+
+func (rb reportBlock) marshal() []byte {
+	data := make([]byte, rtcpReportBlockSize)
+	putUint32(data[0:], rb.ssrc)
+	putUint32(data[4:], rb.cumulativeLost&0xffffff)
+	data[4] = rb.fractionLost
+	putUint32(data[8:], rb.highestSeq)
+	putUint32(data[12:], rb.jitter)
+	putUint32(data[16:], rb.lsr)
+	putUint32(data[20:], rb.dlsr)
+	return data
+}
+
+// The report blocks in an SR or RR
+func (pkt rtcpPacket) reportBlocks() []reportBlock {
+	offset := rtcpHeaderSize
+	if pkt.pt() == rtcpTypeSR {
+		offset += rtcpSenderInfoSize
+	}
+
+	var blocks []reportBlock
+	for i := 0; i < int(pkt.count()); i += 1 {
+		start := offset + i*rtcpReportBlockSize
+		if start+rtcpReportBlockSize > len(pkt) {
+			break
+		}
+
+		data := pkt[start:]
+		blocks = append(blocks, reportBlock{
+			ssrc:           readUint32(data[0:]),
+			fractionLost:   data[4],
+			cumulativeLost: readUint32(data[4:]) & 0xffffff,
+			highestSeq:     readUint32(data[8:]),
+			jitter:         readUint32(data[12:]),
+			lsr:            readUint32(data[16:]),
+			dlsr:           readUint32(data[20:]),
+		})
+	}
+	return blocks
+}
+
+func newReceiverReport(ssrc uint32, blocks []reportBlock) rtcpPacket {
+	if len(blocks) > rtcpMaxCount {
+		blocks = blocks[:rtcpMaxCount]
+	}
+
+	body := make([]byte, rtcpHeaderSize, rtcpHeaderSize+rtcpReportBlockSize*len(blocks))
+	putUint32(body[4:], ssrc)
+	for _, rb := range blocks {
+		body = append(body, rb.marshal()...)
+	}
+	return newRTCPPacket(uint8(len(blocks)), rtcpTypeRR, body)
+}
+
+//////////
+
+// An AES-GCM SRTCP context for one direction of one association.  The
+// whole compound packet after the first eight octets is encrypted, and
+// every packet carries its index in the clear.
+//
+// https://tools.ietf.org/html/rfc7714#section-9
+const (
+	srtcpLabelKey    = 0x03
+	srtcpLabelSalt   = 0x05
+	srtcpTrailerSize = 4 // E flag + SRTCP index
+	srtcpEFlag       = 0x80000000
+	srtcpMaxIndex    = 0x7fffffff
+)
+
+type srtcpContext struct {
+	aead   cipher.AEAD
+	salt   []byte
+	index  uint32
+	replay replayWindow // of the indices received
+}
+
+func newSRTCPContext(masterKey, masterSalt []byte) (*srtcpContext, error) {
+	if len(masterKey) != 16 && len(masterKey) != 32 {
+		return nil, fmt.Errorf("Invalid SRTCP master key length [%d]", len(masterKey))
+	}
+
+	if len(masterSalt) != gcmSaltLength {
+		return nil, fmt.Errorf("Invalid SRTCP master salt length [%d]", len(masterSalt))
+	}
+
+	key, err := srtpKDF(masterKey, masterSalt, srtcpLabelKey, len(masterKey))
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := srtpKDF(masterKey, masterSalt, srtcpLabelSalt, gcmSaltLength)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &srtcpContext{aead: aead, salt: salt}, nil
+}
+
+// IV = (0x0000 || SSRC || 0x0000 || 0 || SRTCP index) XOR salt
+func (ctx *srtcpContext) nonce(ssrc, index uint32) []byte {
+	iv := make([]byte, gcmNonceLength)
+	putUint32(iv[2:], ssrc)
+	putUint32(iv[8:], index&srtcpMaxIndex)
+
+	for i := range iv {
+		iv[i] ^= ctx.salt[i]
+	}
+	return iv
+}
+
+func (ctx *srtcpContext) protect(msg []byte) []byte {
+	index := ctx.index
+	ctx.index = (ctx.index + 1) & srtcpMaxIndex
+
+	trailer := make([]byte, srtcpTrailerSize)
+	putUint32(trailer, srtcpEFlag|index)
+
+	aad := append(append([]byte{}, msg[:rtcpHeaderSize]...), trailer...)
+	out := make([]byte, rtcpHeaderSize, len(msg)+gcmTagLength+srtcpTrailerSize)
+	copy(out, msg)
+	out = ctx.aead.Seal(out, ctx.nonce(readUint32(msg[4:]), index), msg[rtcpHeaderSize:], aad)
+	return append(out, trailer...)
+}
+
+func (ctx *srtcpContext) unprotect(msg []byte) ([]byte, error) {
+	if len(msg) < rtcpHeaderSize+gcmTagLength+srtcpTrailerSize {
+		return nil, fmt.Errorf("SRTCP packet too short [%d]", len(msg))
+	}
+
+	trailer := msg[len(msg)-srtcpTrailerSize:]
+	index := readUint32(trailer)
+	if index&srtcpEFlag == 0 {
+		return nil, fmt.Errorf("Unencrypted SRTCP is not supported")
+	}
+	if ctx.replay.replayed(uint64(index & srtcpMaxIndex)) {
+		return nil, fmt.Errorf("SRTCP packet replayed")
+	}
+
+	header := msg[:rtcpHeaderSize]
+	aad := append(append([]byte{}, header...), trailer...)
+	body := msg[rtcpHeaderSize : len(msg)-srtcpTrailerSize]
+	plaintext, err := ctx.aead.Open(nil, ctx.nonce(readUint32(header[4:]), index), body, aad)
+	if err != nil {
+		return nil, fmt.Errorf("SRTCP authentication failed")
+	}
+
+	ctx.replay.accept(uint64(index & srtcpMaxIndex))
+	return append(append([]byte{}, header...), plaintext...), nil
+}
@@ -0,0 +1,164 @@
+package percy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+var (
+	// SR from 0x01020304 with one report block
+	rtcpSR = unhex("81c8000c01020304" +
+		"0000000100000002" + "00000003" + "00000004" + "00000005" +
+		"0a0b0c0d" + "01000002" + "00000003" + "00000004" + "00000005" + "00000006")
+
+	// PLI from 0x01020304 about 0x0a0b0c0d
+	rtcpPLI = unhex("81ce0002010203040a0b0c0d")
+
+	// FIR from 0x01020304 about 0x0a0b0c0d and 0x0e0f1011
+	rtcpFIR = unhex("84ce000601020304000000000a0b0c0d010000000e0f101102000000")
+
+	// REMB from 0x01020304 about 0x0a0b0c0d: 1 SSRC, exp 2, mantissa 0x3ffff
+	rtcpREMB = unhex("8fce000501020304000000005245" + "4d42010bffff0a0b0c0d")
+
+	// NACK from 0x01020304 about 0x0a0b0c0d for 0x0100 and 0x0102
+	rtcpNACK = unhex("81cd0003010203040a0b0c0d01000002")
+
+	// BYE for 0x01020304 and 0x05060708
+	rtcpBYE = unhex("82cb00020102030405060708")
+)
+
+func TestSplitRTCP(t *testing.T) {
+	compound := append(append(append([]byte{}, rtcpSR...), rtcpPLI...), rtcpBYE...)
+	pkts, err := splitRTCP(compound)
+	assert.NotError(t, err, "Failed to split compound RTCP")
+	assert.Equal(t, len(pkts), 3, "Wrong number of RTCP packets")
+	assert.Equal(t, pkts[0].pt(), uint8(rtcpTypeSR), "Wrong PT")
+	assert.Equal(t, pkts[0].count(), uint8(1), "Wrong report count")
+	assert.Equal(t, pkts[0].ssrc(), uint32(0x01020304), "Wrong sender SSRC")
+	assert.BytesEqual(t, joinRTCP(pkts), compound, "Compound packet did not round-trip")
+
+	_, err = splitRTCP(rtcpSR[:20])
+	assert.True(t, err != nil, "Split a truncated packet")
+	_, err = splitRTCP(append(append([]byte{}, rtcpPLI...), 0x81))
+	assert.True(t, err != nil, "Split a packet with trailing garbage")
+	_, err = splitRTCP([]byte{})
+	assert.True(t, err != nil, "Split an empty packet")
+}
+
+func TestRTCPPackets(t *testing.T) {
+	sr := rtcpPacket(rtcpSR).senderInfo()
+	assert.Equal(t, sr.count(), uint8(0), "Report blocks not stripped")
+	assert.Equal(t, len(sr), rtcpHeaderSize+rtcpSenderInfoSize, "Wrong SR length")
+	assert.BytesEqual(t, sr[4:], rtcpSR[4:len(sr)], "Sender info changed")
+
+	targets := rtcpPacket(rtcpPLI).feedbackTargets()
+	assert.Equal(t, len(targets), 1, "Wrong PLI targets")
+	assert.Equal(t, targets[0], uint32(0x0a0b0c0d), "Wrong PLI target")
+
+	targets = rtcpPacket(rtcpFIR).feedbackTargets()
+	assert.Equal(t, len(targets), 2, "Wrong FIR targets")
+	assert.Equal(t, targets[1], uint32(0x0e0f1011), "Wrong FIR target")
+
+	assert.True(t, rtcpPacket(rtcpREMB).isREMB(), "REMB not recognized")
+	targets = rtcpPacket(rtcpREMB).feedbackTargets()
+	assert.Equal(t, len(targets), 1, "Wrong REMB targets")
+	assert.Equal(t, targets[0], uint32(0x0a0b0c0d), "Wrong REMB target")
+
+	assert.Equal(t, rtcpPacket(rtcpREMB).rembBitrate(), uint64(0x3ffff<<2), "Wrong REMB bitrate")
+	remb := newREMB(0x01020304, 0x3ffff<<2, []uint32{0x0a0b0c0d})
+	assert.BytesEqual(t, remb, rtcpREMB, "Wrong REMB")
+
+	// Precision is lost above 18 bits
+	remb = newREMB(0x01020304, 3000000007, []uint32{0x0a0b0c0d, 0x0e0f1011})
+	assert.Equal(t, remb.rembBitrate(), uint64(3000000007)>>14<<14, "Wrong REMB bitrate")
+	assert.Equal(t, len(remb.feedbackTargets()), 2, "Wrong REMB targets")
+
+	blocks := rtcpPacket(rtcpSR).reportBlocks()
+	assert.Equal(t, len(blocks), 1, "Wrong number of report blocks")
+	assert.Equal(t, blocks[0], reportBlock{
+		ssrc: 0x0a0b0c0d, fractionLost: 1, cumulativeLost: 2,
+		highestSeq: 3, jitter: 4, lsr: 5, dlsr: 6,
+	}, "Wrong report block")
+
+	pids := rtcpPacket(rtcpNACK).nackPIDs()
+	assert.Equal(t, len(pids), 2, "Wrong number of NACK PIDs")
+	assert.Equal(t, pids[0], uint16(0x0100), "Wrong NACK PID")
+	assert.Equal(t, pids[1], uint16(0x0102), "Wrong NACK PID from BLP")
+
+	nack := newNACK(0x01020304, 0x0a0b0c0d, pids)
+	assert.BytesEqual(t, nack, rtcpNACK, "Wrong NACK")
+
+	// PIDs more than 16 apart need separate FCI entries, including across
+	// a wrap
+	pids = []uint16{0xfffe, 0x0001, 0x0010}
+	nack = newNACK(0x01020304, 0x0a0b0c0d, pids)
+	assert.BytesEqual(t, nack[rtcpFeedbackSize:], unhex("fffe0004"+"00100000"), "Wrong NACK FCI")
+	assert.Equal(t, len(nack.nackPIDs()), 3, "NACK did not round-trip")
+
+	bye := rtcpPacket(rtcpBYE).byeSSRCs()
+	assert.Equal(t, len(bye), 2, "Wrong number of BYE SSRCs")
+	assert.Equal(t, bye[1], uint32(0x05060708), "Wrong BYE SSRC")
+
+	rr := newReceiverReport(0x11223344, []reportBlock{{
+		ssrc: 0x0a0b0c0d, fractionLost: 1, cumulativeLost: 2,
+		highestSeq: 3, jitter: 4, lsr: 5, dlsr: 6,
+	}})
+	assert.BytesEqual(t, rr, unhex("81c90007112233440a0b0c0d01000002000000030000000400000005"+
+		"00000006"), "Wrong receiver report")
+}
+
+func TestSRTCP(t *testing.T) {
+	send, err := newSRTCPContext(hbhKeyA, hbhSalA)
+	assert.NotError(t, err, "Failed to create SRTCP context")
+	recv, _ := newSRTCPContext(hbhKeyA, hbhSalA)
+
+	compound := append(append([]byte{}, rtcpSR...), rtcpPLI...)
+	msg := send.protect(compound)
+	assert.Equal(t, len(msg), len(compound)+gcmTagLength+srtcpTrailerSize, "Wrong SRTCP length")
+	assert.BytesEqual(t, msg[:rtcpHeaderSize], compound[:rtcpHeaderSize], "Header not in the clear")
+	assert.BytesEqual(t, msg[len(msg)-4:], []byte{0x80, 0x00, 0x00, 0x00}, "Wrong SRTCP index")
+
+	plaintext, err := recv.unprotect(msg)
+	assert.NotError(t, err, "Failed to decrypt SRTCP")
+	assert.BytesEqual(t, plaintext, compound, "SRTCP did not round-trip")
+
+	_, err = recv.unprotect(msg)
+	assert.True(t, err != nil, "Replayed SRTCP accepted")
+
+	// The index advances, and is authenticated
+	msg = send.protect(compound)
+	assert.BytesEqual(t, msg[len(msg)-4:], []byte{0x80, 0x00, 0x00, 0x01}, "SRTCP index did not advance")
+	msg[len(msg)-1] = 0x02
+	_, err = recv.unprotect(msg)
+	assert.True(t, err != nil, "Modified SRTCP index authenticated")
+
+	other, _ := newSRTCPContext(hbhKeyB, hbhSalB)
+	_, err = other.unprotect(send.protect(compound))
+	assert.True(t, err != nil, "SRTCP authenticated with the wrong key")
+}
+
+func TestReceiverStats(t *testing.T) {
+	now := time.Now()
+	stats := newReceiverStats(0xfffe, audioClockRate)
+
+	// 0xfffe, 0xffff, [0x0000 lost], 0x0001, then a late 0xfffd
+	for _, seq := range []uint16{0xfffe, 0xffff, 0x0001, 0xfffd} {
+		stats.update(seq, uint32(seq)*960, now)
+	}
+
+	rb := stats.report(0x0a0b0c0d, now)
+	assert.Equal(t, rb.highestSeq, uint32(0x10001), "Wrong extended highest sequence number")
+	assert.Equal(t, rb.cumulativeLost, uint32(0), "Late packet not counted")
+
+	stats.update(0x0004, 4*960, now)
+	rb = stats.report(0x0a0b0c0d, now)
+	assert.Equal(t, rb.cumulativeLost, uint32(2), "Wrong cumulative loss")
+	assert.Equal(t, rb.fractionLost, uint8(2*256/3), "Wrong fraction lost")
+
+	stats.senderReport(0x0001000200030004, now)
+	rb = stats.report(0x0a0b0c0d, now.Add(time.Second))
+	assert.Equal(t, rb.lsr, uint32(0x00020003), "Wrong LSR")
+	assert.Equal(t, rb.dlsr, uint32(65536), "Wrong DLSR")
+}
@@ -1,12 +1,20 @@
 package percy
 
 import (
-	"math"
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 )
 
 const (
-	NumSpeakers = 2
+	NumSpeakers = 2 // default number of speakers forwarded in a conference
+
+	MaxTemporalLayer = 7 // the highest TID frame marking can express
+
+	MaxThumbnails = 16 // most thumbnails a client can ask for
+
+	silenceEnergy = -127.0 // lowest level RFC 6464 can express
 )
 
 /* The SessionID uniquely identifiers each session from each endpoint connected to the SFU. If a single user is connected with more than one endpoingpint, they will have differnt ClientID values */
@@ -17,21 +25,71 @@ type ConfID uint32
 
 // this keeps track of the energy levels from singl speaker in a confernces
 type SFUClient struct {
-	lastEnergy     float64 // in dB below zero
+	estimator      EnergyEstimator
 	lastEnergyTime time.Time
-	energy         float64 // in dB below zero
+	lastVAD        bool
+	energy         float64 // in dB below zero, as of the last updateSpeakers
+}
+
+// options that can be set when a confernce is created
+type ConfOptions struct {
+	MaxClients  int // zero means no limit
+	NumSpeakers int // speakers forwarded (last-N), at most one per audio slot; zero means the default
 }
 
 // this keep strack of all the clients in a confernce
 type SFUConf struct {
+	id                     ConfID
+	options                ConfOptions
+	created                time.Time
 	clientList             map[ClientID]*SFUClient
-	speakers               []ClientID // first is active, second is previos, aditional are extra
+	speakers               []ClientID // first is active, second is previos, aditional are extra; zero is an empty slot
 	activeSpeakerStartTime time.Time
 }
 
+// a snapshot of the state of a confernce, returned by Inspect
+type ConfInfo struct {
+	ID       ConfID
+	Options  ConfOptions
+	Created  time.Time
+	Members  []ClientID // sorted
+	Speakers []ClientID
+	Muted    []ClientID // audio muted, sorted
+	NoVideo  []ClientID // video muted, sorted
+}
+
+// whether a client's audio and video are muted, by the client itself or by
+// the server (e.g., a moderator).  Either one mutes it.
+type MuteState struct {
+	SelfAudio   bool
+	SelfVideo   bool
+	ServerAudio bool
+	ServerVideo bool
+}
+
+func (state MuteState) Audio() bool {
+	return state.SelfAudio || state.ServerAudio
+}
+
+func (state MuteState) Video() bool {
+	return state.SelfVideo || state.ServerVideo
+}
+
 type Destination struct {
 	clientID ClientID
 	pt       int8
+	slot     int   // for audio, the index in audioPTList, since slots can share a PT
+	view     int   // for video, 0 is the main view and the rest are thumbnails
+	layer    int   // simulcast layer for video, 0 is the lowest
+	maxTID   uint8 // highest temporal layer for video
+}
+
+// what video a client wants to see.  The zero value follows the speaker:
+// the active speaker in the main view, or the previous speaker for the
+// active speaker itself.
+type VideoLayout struct {
+	Pin        ClientID // in the main view instead of the speaker, while it is in the conference
+	Thumbnails int      // how many other clients to show as thumbnails, speakers first
 }
 
 type Source struct {
@@ -40,78 +98,526 @@ type Source struct {
 }
 
 // this is a singleton to keep track of all the conferences
+//
+// All of the exported methods are safe to call from multiple goroutines;
+// mu guards every map below, and the unexported helpers expect it to be held
 type SFU struct {
+	mu sync.Mutex
+
 	confIdMap map[ClientID]ConfID
 	confMap   map[ConfID]*SFUConf
-	muteMap   map[ClientID]bool
+	muteMap   map[ClientID]MuteState
+
+	bandwidthMap map[ClientID]uint64   // estimated bits per second each client can receive
+	layerMap     map[ClientID][]uint64 // bitrates of each client's simulcast layers, lowest first
+	layoutMap    map[ClientID]VideoLayout
 
 	audioPTList []int8 // first one is primary speaker, 2nd the secondary and so on - for now assumes all are opus
 
 	fibMap map[Source][]Destination
+
+	policy SpeakerPolicy
+
+	subscribers map[ConfID][]chan Event // see events.go
 }
 
+// An SFU with no audio PTs forwards only video
 func NewSFU(audioPTList []int8) *SFU {
 	sfu := new(SFU)
 	sfu.audioPTList = audioPTList
+	sfu.confIdMap = map[ClientID]ConfID{}
+	sfu.confMap = map[ConfID]*SFUConf{}
+	sfu.muteMap = map[ClientID]MuteState{}
+	sfu.bandwidthMap = map[ClientID]uint64{}
+	sfu.layerMap = map[ClientID][]uint64{}
+	sfu.layoutMap = map[ClientID]VideoLayout{}
+	sfu.fibMap = map[Source][]Destination{}
+	sfu.policy = NewBaselinePolicy()
+	sfu.subscribers = map[ConfID][]chan Event{}
 
 	return sfu
 }
 
+func newSFUClient(policy SpeakerPolicy) *SFUClient {
+	client := new(SFUClient)
+	client.estimator = policy.NewEstimator()
+	client.energy = silenceEnergy
+	return client
+}
+
+func newSFUConf(confID ConfID, opts ConfOptions) *SFUConf {
+	conf := new(SFUConf)
+	conf.id = confID
+	conf.options = opts
+	conf.created = time.Now()
+	conf.clientList = map[ClientID]*SFUClient{}
+	conf.speakers = make([]ClientID, opts.NumSpeakers)
+	return conf
+}
+
+// fill in the number of speakers, which can't be more than there are audio
+// slots to put them in
+func (sfu *SFU) speakerOptions(opts ConfOptions) (ConfOptions, error) {
+	if opts.NumSpeakers < 0 || opts.NumSpeakers > len(sfu.audioPTList) {
+		return opts, fmt.Errorf("Invalid number of speakers [%d], there are %d audio slots",
+			opts.NumSpeakers, len(sfu.audioPTList))
+	}
+
+	if opts.NumSpeakers == 0 {
+		opts.NumSpeakers = NumSpeakers
+		if opts.NumSpeakers > len(sfu.audioPTList) {
+			opts.NumSpeakers = len(sfu.audioPTList)
+		}
+	}
+	return opts, nil
+}
+
+func sortClientIDs(clientIDs []ClientID) []ClientID {
+	sort.Slice(clientIDs, func(i, j int) bool { return clientIDs[i] < clientIDs[j] })
+	return clientIDs
+}
+
+// creates an empty confernce
+func (sfu *SFU) CreateConf(confID ConfID, opts ConfOptions) error {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	if _, ok := sfu.confMap[confID]; ok {
+		return fmt.Errorf("Conference [%v] already exists", confID)
+	}
+
+	opts, err := sfu.speakerOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	sfu.confMap[confID] = newSFUConf(confID, opts)
+	return nil
+}
+
+// removes all clients from a confernence and forgets about it
+func (sfu *SFU) DestroyConf(confID ConfID) error {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	if _, ok := sfu.confMap[confID]; !ok {
+		return fmt.Errorf("Unknown conference [%v]", confID)
+	}
+
+	sfu.stopConf(confID)
+	delete(sfu.confMap, confID)
+
+	// there will be no more events for it
+	for _, ch := range sfu.subscribers[confID] {
+		close(ch)
+	}
+	delete(sfu.subscribers, confID)
+	return nil
+}
+
+// list of all the confernces, in order
+func (sfu *SFU) Conferences() []ConfID {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	confIDs := make([]ConfID, 0, len(sfu.confMap))
+	for confID := range sfu.confMap {
+		confIDs = append(confIDs, confID)
+	}
+	sort.Slice(confIDs, func(i, j int) bool { return confIDs[i] < confIDs[j] })
+	return confIDs
+}
+
+// get a snapshot of a confernce
+func (sfu *SFU) Inspect(confID ConfID) (ConfInfo, error) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	conf, ok := sfu.confMap[confID]
+	if !ok {
+		return ConfInfo{}, fmt.Errorf("Unknown conference [%v]", confID)
+	}
+
+	info := ConfInfo{
+		ID:       confID,
+		Options:  conf.options,
+		Created:  conf.created,
+		Members:  sfu.members(conf),
+		Speakers: append([]ClientID{}, conf.speakers...),
+		Muted:    []ClientID{},
+		NoVideo:  []ClientID{},
+	}
+	for _, clientID := range info.Members {
+		if sfu.muteMap[clientID].Audio() {
+			info.Muted = append(info.Muted, clientID)
+		}
+		if sfu.muteMap[clientID].Video() {
+			info.NoVideo = append(info.NoVideo, clientID)
+		}
+	}
+	return info, nil
+}
+
+// list of clients in a confernce, in order
+func (sfu *SFU) Members(confID ConfID) []ClientID {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	conf, ok := sfu.confMap[confID]
+	if !ok {
+		return nil
+	}
+	return sfu.members(conf)
+}
+
+func (sfu *SFU) members(conf *SFUConf) []ClientID {
+	clientIDs := make([]ClientID, 0, len(conf.clientList))
+	for clientID := range conf.clientList {
+		clientIDs = append(clientIDs, clientID)
+	}
+	return sortClientIDs(clientIDs)
+}
+
+// which confernce a client is in
+func (sfu *SFU) ClientConf(clientID ClientID) (ConfID, bool) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	confID, ok := sfu.confIdMap[clientID]
+	return confID, ok
+}
+
 // removes a client from a conference
-func (sfu *SFU) RemoveClient(confID ConfID, clientID ClientID) {
-	// remove client from any existing confernces
+func (sfu *SFU) RemoveClient(confID ConfID, clientID ClientID) error {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	if currentConfID, ok := sfu.confIdMap[clientID]; !ok || currentConfID != confID {
+		return fmt.Errorf("Client [%v] is not in conference [%v]", clientID, confID)
+	}
+
+	sfu.removeClient(confID, clientID)
+	return nil
+}
+
+func (sfu *SFU) removeClient(confID ConfID, clientID ClientID) {
 	conf, ok := sfu.confMap[confID]
 	if ok {
 		delete(conf.clientList, clientID)
+		sfu.emit(Event{Type: EventLeave, ConfID: confID, ClientID: clientID})
+		sfu.updateSpeakers(conf, time.Now())
 	}
 	delete(sfu.confIdMap, clientID)
+	delete(sfu.muteMap, clientID)
+	delete(sfu.bandwidthMap, clientID)
+	delete(sfu.layerMap, clientID)
+	delete(sfu.layoutMap, clientID)
+
+	// stop forwarding anything from this client
+	if len(sfu.audioPTList) > 0 {
+		delete(sfu.fibMap, Source{clientID: clientID, pt: sfu.audioPTList[0]})
+	}
+	delete(sfu.fibMap, Source{clientID: clientID, pt: 0})
+
+	if ok {
+		sfu.updateFIB(conf)
+	}
 }
 
-// adds a clients to a confernence
-func (sfu *SFU) AddClient(confID ConfID, clientID ClientID) {
+// adds a clients to a confernence, creating it with default options if
+// it does not exist yet
+func (sfu *SFU) AddClient(confID ConfID, clientID ClientID) error {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
 	//  create confernce if it does not eist
 	conf, ok := sfu.confMap[confID]
 	if !ok {
-		sfu.confMap[confID] = new(SFUConf)
+		opts, _ := sfu.speakerOptions(ConfOptions{})
+		conf = newSFUConf(confID, opts)
+		sfu.confMap[confID] = conf
+	}
+
+	if oldConfID, ok := sfu.confIdMap[clientID]; ok && oldConfID == confID {
+		return nil
+	}
+
+	if conf.options.MaxClients > 0 && len(conf.clientList) >= conf.options.MaxClients {
+		return fmt.Errorf("Conference [%v] is full", confID)
 	}
 
-	sfu.RemoveClient(confID, clientID)
+	// remove client from whatever confernce it was in before.  Its mute
+	// state goes with it, so that a moderator's mute can't be escaped by
+	// moving.
+	if oldConfID, ok := sfu.confIdMap[clientID]; ok {
+		mute := sfu.muteMap[clientID]
+		sfu.removeClient(oldConfID, clientID)
+		sfu.muteMap[clientID] = mute
+	}
 
 	// add client to this this confernce
 	sfu.confIdMap[clientID] = confID
-	conf.clientList[clientID] = new(SFUClient)
+	conf.clientList[clientID] = newSFUClient(sfu.policy)
+	sfu.emit(Event{Type: EventJoin, ConfID: confID, ClientID: clientID})
+
+	sfu.updateFIB(conf)
+	return nil
 }
 
-// removes all clients from a confernence
+// removes all clients from a confernence, but leaves it in place
 func (sfu *SFU) StopConf(confID ConfID) {
-	conf := sfu.confMap[confID]
-	if conf != nil {
-		for clientID := range conf.clientList {
-			sfu.RemoveClient(confID, clientID)
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	sfu.stopConf(confID)
+}
+
+func (sfu *SFU) stopConf(confID ConfID) {
+	conf, ok := sfu.confMap[confID]
+	if !ok {
+		return
+	}
+
+	for clientID := range conf.clientList {
+		sfu.removeClient(confID, clientID)
+	}
+	conf.speakers = make([]ClientID, conf.options.NumSpeakers)
+}
+
+// change how speakers are chosen.  Energy estimates start over.
+func (sfu *SFU) SetSpeakerPolicy(policy SpeakerPolicy) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	sfu.policy = policy
+	for _, conf := range sfu.confMap {
+		for _, client := range conf.clientList {
+			client.estimator = policy.NewEstimator()
 		}
 	}
-	sfu.confMap[confID] = nil
 }
 
-// Mute or Unmute a client in a congference
+// Mute or Unmute a client's audio from the server side, leaving its video
+// as it is
 func (sfu *SFU) Mute(clientID ClientID, mute bool) {
-	sfu.muteMap[clientID] = mute
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	state := sfu.muteMap[clientID]
+	state.ServerAudio = mute
+	sfu.setMute(clientID, state)
+}
+
+// Mute or Unmute a client's audio and video from the server side (e.g., by
+// a moderator).  The client can't undo this, including by moving to
+// another conference; the MDD also carries it over to a new association
+// for the same registration.
+func (sfu *SFU) ServerMute(clientID ClientID, audio, video bool) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	state := sfu.muteMap[clientID]
+	state.ServerAudio = audio
+	state.ServerVideo = video
+	sfu.setMute(clientID, state)
+}
+
+// Record that a client has muted or unmuted its own audio and video
+func (sfu *SFU) SelfMute(clientID ClientID, audio, video bool) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	state := sfu.muteMap[clientID]
+	state.SelfAudio = audio
+	state.SelfVideo = video
+	sfu.setMute(clientID, state)
+}
+
+// muted clients can't be speakers, and nothing they send is forwarded for
+// the media they have muted
+func (sfu *SFU) setMute(clientID ClientID, state MuteState) {
+	if state == sfu.muteMap[clientID] {
+		return
+	}
+	sfu.muteMap[clientID] = state
+
+	confID, ok := sfu.confIdMap[clientID]
+	if !ok {
+		return
+	}
+	sfu.emit(Event{Type: EventMute, ConfID: confID, ClientID: clientID, Mute: state})
+
+	if conf, ok := sfu.confMap[confID]; ok {
+		sfu.updateSpeakers(conf, time.Now())
+		sfu.updateFIB(conf)
+	}
+}
+
+// Is a client's audio muted
+func (sfu *SFU) IsMuted(clientID ClientID) bool {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	return sfu.muteMap[clientID].Audio()
+}
+
+// How a client is muted
+func (sfu *SFU) MuteState(clientID ClientID) MuteState {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	return sfu.muteMap[clientID]
+}
+
+// Tell the SFU how much bandwidth (bits per second) a client can receive
+func (sfu *SFU) SetBandwidth(clientID ClientID, bps uint64) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	sfu.bandwidthMap[clientID] = bps
+	sfu.updateClientFIB(clientID)
+}
+
+// How much bandwidth a client can receive, if it is known
+func (sfu *SFU) Bandwidth(clientID ClientID) (uint64, bool) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	bps, ok := sfu.bandwidthMap[clientID]
+	return bps, ok
+}
+
+// Tell the SFU about the video layers a client sends, as their bitrates
+// in bits per second, lowest layer first.  Without simulcast there is
+// just the one.
+func (sfu *SFU) SetLayers(clientID ClientID, bitrates []uint64) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	sfu.layerMap[clientID] = append([]uint64{}, bitrates...)
+	sfu.updateClientFIB(clientID)
+}
+
+// Choose the video a client sees
+func (sfu *SFU) SetVideoLayout(clientID ClientID, layout VideoLayout) error {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	confID, ok := sfu.confIdMap[clientID]
+	if !ok {
+		return fmt.Errorf("Client [%v] is not in a conference", clientID)
+	}
+
+	if layout.Thumbnails < 0 || layout.Thumbnails > MaxThumbnails {
+		return fmt.Errorf("Invalid number of thumbnails [%d], at most %d", layout.Thumbnails, MaxThumbnails)
+	}
+
+	if pinConfID, ok := sfu.confIdMap[layout.Pin]; layout.Pin != 0 && (!ok || pinConfID != confID) {
+		return fmt.Errorf("Client [%v] is not in conference [%v]", layout.Pin, confID)
+	}
+
+	sfu.layoutMap[clientID] = layout
+	sfu.updateClientFIB(clientID)
+	return nil
+}
+
+// The video a client has asked to see
+func (sfu *SFU) VideoLayout(clientID ClientID) VideoLayout {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	return sfu.layoutMap[clientID]
+}
+
+// recompute forwarding for the conference a client is in
+func (sfu *SFU) updateClientFIB(clientID ClientID) {
+	confID, ok := sfu.confIdMap[clientID]
+	if !ok {
+		return
+	}
+
+	if conf, ok := sfu.confMap[confID]; ok {
+		sfu.updateFIB(conf)
+	}
+}
+
+// pick which of a sender's simulcast layers a receiver gets.  The main
+// view gets the highest layer, anything else the lowest, and either is
+// dropped to a layer that fits the receiver's bandwidth where possible.
+func (sfu *SFU) chooseLayer(srcClientID, destClientID ClientID, main bool) int {
+	layers := sfu.layerMap[srcClientID]
+	if len(layers) == 0 {
+		return 0
+	}
+
+	layer := 0
+	if main {
+		layer = len(layers) - 1
+	}
+
+	if bps, ok := sfu.bandwidthMap[destClientID]; ok {
+		for layer > 0 && layers[layer] > bps {
+			layer -= 1
+		}
+	}
+	return layer
+}
+
+// pick the highest temporal layer a receiver gets of the video layer it
+// gets from a sender.  Thumbnails only get the base layer, which is enough
+// for a lower frame rate.  If even the lowest video layer doesn't fit the
+// receiver's bandwidth, the frame rate is cut to make it fit: typically
+// the base layer is about half the bitrate, and the first enhancement
+// layer another quarter.
+func (sfu *SFU) chooseTemporal(srcClientID, destClientID ClientID, layer int, main bool) uint8 {
+	if !main {
+		return 0
+	}
+
+	layers := sfu.layerMap[srcClientID]
+	bps, ok := sfu.bandwidthMap[destClientID]
+	if !ok || layer >= len(layers) || layers[layer] <= bps {
+		return MaxTemporalLayer
+	}
+
+	if layers[layer]*3/4 <= bps {
+		return 1
+	}
+	return 0
 }
 
 // Get list of active speakers - first one will be main one, second will be previous speaker
 func (sfu *SFU) ActiveSpeakers(confID ConfID) []ClientID {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
 	conf, ok := sfu.confMap[confID]
 	if !ok {
 		return nil
 	}
 
-	return conf.speakers
+	return append([]ClientID{}, conf.speakers...)
+}
+
+// Whether a PT carries audio.  audioPTList never changes after NewSFU, so
+// this doesn't need the lock.
+func (sfu *SFU) isAudioPT(pt int8) bool {
+	for _, audioPT := range sfu.audioPTList {
+		if pt == audioPT {
+			return true
+		}
+	}
+	return false
 }
 
-// Get Forwarding Map for Packets
+// Get Forwarding Map for Packets - audio is keyed by the first entry in
+// audioPTList, everything else is treated as video.  The returned slice
+// is never modified by the SFU, so it is safe to use after the call.
 func (sfu *SFU) GetFibEntry(clientID ClientID, pt int8) []Destination {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
 
-	if pt != sfu.audioPTList[0] {
+	if len(sfu.audioPTList) == 0 || pt != sfu.audioPTList[0] {
 		pt = 0
 	}
 
@@ -123,7 +629,10 @@ func (sfu *SFU) GetFibEntry(clientID ClientID, pt int8) []Destination {
 }
 
 // this processing an incoming packet and returns a list of packet to send to clients
-func (sfu *SFU) UpdateEnergy(clientID ClientID, dBov int8) {
+// dBov and vad are the level and voice activity flag from RFC 6464
+func (sfu *SFU) UpdateEnergy(clientID ClientID, dBov int8, vad bool) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
 
 	// is the client in a conference
 	confId, okClient := sfu.confIdMap[clientID]
@@ -144,85 +653,216 @@ func (sfu *SFU) UpdateEnergy(clientID ClientID, dBov int8) {
 	}
 
 	// update the energy
-	if dBov != 0 {
-		client.updateEnergy(dBov)
+	now := time.Now()
+	if dBov < 0 {
+		client.estimator.Update(dBov, vad, now)
+		client.lastEnergyTime = now
+		client.lastVAD = vad
 	}
 
 	// update active speaker list
-	sfu.updateSpeakers(conf)
+	sfu.updateSpeakers(conf, now)
 
 	sfu.updateFIB(conf) // TODO - don't update as often
 
 }
 
-func (client *SFUClient) updateEnergy(dBov int8) {
-	if dBov >= 0 {
-		return
+// re-evaluate the speakers in every conference, so that speakers decay and
+// roll off even when no packets arrive.  The MDD calls this on a ticker.
+func (sfu *SFU) UpdateSpeakers(now time.Time) {
+	sfu.mu.Lock()
+	defer sfu.mu.Unlock()
+
+	for _, conf := range sfu.confMap {
+		if sfu.updateSpeakers(conf, now) {
+			sfu.updateFIB(conf)
+		}
 	}
-	db := float64(dBov)
+}
 
-	now := time.Now()
-	if now.Sub(client.lastEnergyTime) > time.Duration(1500*time.Millisecond) {
-		// just replace old endergy measurements - too old to care
-		client.energy = db
-	} else {
-		// TODO - fix for rolling average later
-		client.energy = math.Max(db, 0.2*db+0.8*client.energy)
+func sameClientIDs(a, b []ClientID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// keeps the list of speakers up to date, and tells subscribers when it
+// changes.  Returns whether it changed.
+func (sfu *SFU) updateSpeakers(conf *SFUConf, now time.Time) bool {
+	before := append([]ClientID{}, conf.speakers...)
+	sfu.electSpeakers(conf, now)
+	if sameClientIDs(before, conf.speakers) {
+		return false
 	}
 
-	client.lastEnergy = db
-	client.lastEnergyTime = now
+	sfu.emit(Event{Type: EventSpeakers, ConfID: conf.id, Speakers: append([]ClientID{}, conf.speakers...)})
+	return true
 }
 
-func (sfu *SFU) updateSpeakers(conf *SFUConf) {
-	if len(conf.speakers) != NumSpeakers {
-		conf.speakers = make([]ClientID, NumSpeakers)
+// keeps the list of the last N speakers up to date.  The first is the
+// active speaker and the second the previous one; the rest are the other
+// loudest recent speakers.  Each speaker's audio goes in its own slot, so
+// speakers keep their places in the list instead of being strictly ranked,
+// and a new speaker only takes a place from one that is clearly quieter.
+func (sfu *SFU) electSpeakers(conf *SFUConf, now time.Time) {
+	if len(conf.speakers) != conf.options.NumSpeakers {
+		conf.speakers = make([]ClientID, conf.options.NumSpeakers)
+	}
+	if len(conf.speakers) == 0 {
+		return
 	}
 
-	// TODO - roll off old speakers
+	th := sfu.policy.Thresholds()
 
-	// build list of trying speakers
-	var trying []ClientID
-	var maxEnergy float64 = -1000.0
-	var maxEnergyClientID ClientID = 0
+	// roll off speakers that have left, muted, or stopped sending levels
+	for i, speaker := range conf.speakers {
+		if speaker == 0 {
+			continue
+		}
+		client, ok := conf.clientList[speaker]
+		if !ok || sfu.muteMap[speaker].Audio() || now.Sub(client.lastEnergyTime) > th.StaleAfter {
+			conf.speakers[i] = 0
+		}
+	}
 
-	for clientID := range conf.clientList {
-		client := conf.clientList[clientID]
-		if client.energy > -35.0 {
+	// the previous speaker takes over from an active speaker that is gone
+	if len(conf.speakers) > 1 && conf.speakers[0] == 0 && conf.speakers[1] != 0 {
+		conf.speakers[0], conf.speakers[1] = conf.speakers[1], 0
+		conf.activeSpeakerStartTime = now
+	}
+
+	// build list of trying speakers, loudest first
+	var trying []ClientID
+	for clientID, client := range conf.clientList {
+		client.energy = client.estimator.Energy(now)
+		if client.energy > th.MinEnergy && !sfu.muteMap[clientID].Audio() {
 			trying = append(trying, clientID)
-			if client.energy > maxEnergy {
-				maxEnergy = client.energy
-				maxEnergyClientID = clientID
-			}
+		}
+	}
+	sort.Slice(trying, func(i, j int) bool {
+		a, b := conf.clientList[trying[i]].energy, conf.clientList[trying[j]].energy
+		return a > b || (a == b && trying[i] < trying[j])
+	})
+
+	// figure out active speaker, which only changes to someone clearly
+	// louder, so that speakers at similar levels don't keep swapping
+	if len(trying) > 0 && trying[0] != conf.speakers[0] {
+		if conf.louder(trying[0], conf.speakers[0], th) && now.Sub(conf.activeSpeakerStartTime) > th.MinDwell {
+			conf.promote(trying[0])
+			conf.activeSpeakerStartTime = now
 		}
 	}
 
-	// figure out active speaker
-	if maxEnergy > -1000.0 {
-		now := time.Now()
-		if now.Sub(conf.activeSpeakerStartTime) > time.Duration(200*time.Millisecond) {
-			if maxEnergyClientID != conf.speakers[0] {
-				// switch active speaker
-				conf.speakers[1] = conf.speakers[0]  // update previos speaker
-				conf.speakers[0] = maxEnergyClientID // new active speaker
-				conf.activeSpeakerStartTime = now
-			}
+	// figure out other speakers to mix in
+	for _, clientID := range trying {
+		if conf.speakerSlot(clientID) >= 0 {
+			continue
+		}
+
+		// the previous speaker only gives up its slot if there is no other
+		slot := conf.speakerSlot(0)
+		if slot <= 0 {
+			slot = conf.quietestSlot(2)
+		}
+		if slot < 0 {
+			slot = conf.quietestSlot(1)
+		}
+		if slot < 0 {
+			break
+		}
+
+		if !conf.louder(clientID, conf.speakers[slot], th) {
+			// the rest are quieter still
+			break
 		}
+		conf.speakers[slot] = clientID
 	}
+}
+
+// whether a client is clearly louder than a speaker, so that it can take
+// the speaker's slot.  Whatever the policy, this is where the hysteresis
+// applies.
+func (conf *SFUConf) louder(clientID, speaker ClientID, th SpeakerThresholds) bool {
+	return speaker == 0 || conf.energy(clientID) > conf.energy(speaker)+th.Hysteresis
+}
+
+// the slot a client is speaking in, or the first empty slot for zero, or -1
+func (conf *SFUConf) speakerSlot(clientID ClientID) int {
+	for i, speaker := range conf.speakers {
+		if speaker == clientID {
+			return i
+		}
+	}
+	return -1
+}
 
-	// TODO figure out other speakers to mix in
+func (conf *SFUConf) energy(clientID ClientID) float64 {
+	client, ok := conf.clientList[clientID]
+	if !ok {
+		return silenceEnergy
+	}
+	return client.energy
+}
 
+// the slot from first on with the quietest speaker, preferring empty ones,
+// or -1 if there are no slots that far down
+func (conf *SFUConf) quietestSlot(first int) int {
+	slot := -1
+	for i := first; i < len(conf.speakers); i += 1 {
+		if conf.speakers[i] == 0 {
+			return i
+		}
+		if slot < 0 || conf.energy(conf.speakers[i]) < conf.energy(conf.speakers[slot]) {
+			slot = i
+		}
+	}
+	return slot
+}
+
+// make a client the active speaker.  The old active speaker becomes the
+// previous speaker, and the old previous speaker takes the new active
+// speaker's old slot, or the quietest one; everyone else stays put.
+func (conf *SFUConf) promote(clientID ClientID) {
+	from := conf.speakerSlot(clientID)
+	if len(conf.speakers) == 1 {
+		conf.speakers[0] = clientID
+		return
+	}
+
+	displaced := conf.speakers[1]
+	conf.speakers[1] = conf.speakers[0]
+	conf.speakers[0] = clientID
+
+	switch {
+	case from >= 2:
+		conf.speakers[from] = displaced
+	case from < 0 && displaced != 0:
+		if slot := conf.quietestSlot(2); slot >= 0 {
+			if conf.speakers[slot] == 0 || conf.energy(displaced) > conf.energy(conf.speakers[slot]) {
+				conf.speakers[slot] = displaced
+			}
+		}
+	}
 }
 
 func (sfu *SFU) updateFIB(conf *SFUConf) {
-	// do audio forwarnding
+	// do audio forwarnding, unless there are no audio PTs to do it on
 	for clientID := range conf.clientList {
+		if len(sfu.audioPTList) == 0 {
+			break
+		}
 
 		var destList []Destination
 
 		// if it is from a speaker, send it to others clients
 		for i := range conf.speakers {
-			if conf.speakers[i] == clientID {
+			if conf.speakers[i] == clientID && !sfu.muteMap[clientID].Audio() {
 				// send it to all others
 				for destClientID := range conf.clientList {
 					if destClientID != clientID {
@@ -230,6 +870,7 @@ func (sfu *SFU) updateFIB(conf *SFUConf) {
 						var dest Destination
 						dest.clientID = destClientID
 						dest.pt = sfu.audioPTList[i]
+						dest.slot = i
 
 						destList = append(destList, dest)
 					}
@@ -239,48 +880,75 @@ func (sfu *SFU) updateFIB(conf *SFUConf) {
 		}
 
 		var src Source
-		src.pt = 0
+		src.pt = sfu.audioPTList[0]
 		src.clientID = clientID
 		sfu.fibMap[src] = destList
 
 	}
 
-	// do video forwarnding
-	for clientID := range conf.clientList {
-		var destList []Destination
-
-		// if video from active speaker, sent to everyone else
-		if conf.speakers[0] == clientID {
-			// send it to all others
-			for destClientID := range conf.clientList {
-				if destClientID != clientID {
-					// send to destClientID
-					var dest Destination
-					dest.clientID = destClientID
-					dest.pt = 0
-
-					destList = append(destList, dest)
-				}
+	// do video forwarnding, from what each client wants to see
+	members := sfu.members(conf)
+	videoDests := map[ClientID][]Destination{}
+	for _, destClientID := range members {
+		for view, clientID := range sfu.videoViews(conf, destClientID, members) {
+			if clientID == 0 {
+				continue
 			}
-		}
 
-		// if from prev speaker, send to active speaker
-		if conf.speakers[1] == clientID {
-			destClientID := conf.speakers[0]
-			if destClientID != clientID {
-				// send to destClientID
-				var dest Destination
-				dest.clientID = destClientID
-				dest.pt = 0
-
-				destList = append(destList, dest)
-			}
+			// send to destClientID
+			var dest Destination
+			dest.clientID = destClientID
+			dest.pt = 0
+			dest.view = view
+			dest.layer = sfu.chooseLayer(clientID, destClientID, view == 0)
+			dest.maxTID = sfu.chooseTemporal(clientID, destClientID, dest.layer, view == 0)
 
+			videoDests[clientID] = append(videoDests[clientID], dest)
 		}
+	}
 
+	for clientID := range conf.clientList {
 		var src Source
 		src.pt = 0
 		src.clientID = clientID
-		sfu.fibMap[src] = destList
+		sfu.fibMap[src] = videoDests[clientID]
+	}
+}
+
+// the clients whose video a client sees, by view: first the main view, then
+// the thumbnails.  Zero is an empty view.
+func (sfu *SFU) videoViews(conf *SFUConf, clientID ClientID, members []ClientID) []ClientID {
+	layout := sfu.layoutMap[clientID]
+	views := make([]ClientID, 1, 1+layout.Thumbnails)
+
+	showable := func(src ClientID) bool {
+		if _, ok := conf.clientList[src]; !ok || src == clientID || sfu.muteMap[src].Video() {
+			return false
+		}
+		for _, shown := range views {
+			if shown == src {
+				return false
+			}
+		}
+		return true
+	}
+
+	// the pinned client, or else the most recent speaker other than this one
+	for _, src := range append([]ClientID{layout.Pin}, conf.speakers...) {
+		if showable(src) {
+			views[0] = src
+			break
+		}
+	}
+
+	// thumbnails of the other speakers, then anyone else
+	for _, src := range append(append([]ClientID{}, conf.speakers...), members...) {
+		if len(views) > layout.Thumbnails {
+			break
+		}
+		if showable(src) {
+			views = append(views, src)
+		}
 	}
+	return views
 }
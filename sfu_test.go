@@ -0,0 +1,440 @@
+package percy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+var (
+	testAudioPTList = []int8{109, 110}
+)
+
+func TestSFUConcurrentAccess(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+
+	var confID ConfID = 1
+	nClients := 10
+	nIterations := 100
+
+	var wg sync.WaitGroup
+	for i := 1; i <= nClients; i += 1 {
+		wg.Add(1)
+		go func(clientID ClientID) {
+			defer wg.Done()
+
+			for j := 0; j < nIterations; j += 1 {
+				sfu.AddClient(confID, clientID)
+				sfu.UpdateEnergy(clientID, int8(-10-j%50), true)
+				sfu.GetFibEntry(clientID, testAudioPTList[0])
+				sfu.GetFibEntry(clientID, 0)
+				sfu.Mute(clientID, j%2 == 0)
+				sfu.ActiveSpeakers(confID)
+				if j%10 == 9 {
+					sfu.RemoveClient(confID, clientID)
+				}
+			}
+		}(ClientID(i))
+	}
+
+	wg.Wait()
+}
+
+func assertClientIDs(t *testing.T, actual, expected []ClientID, msg string) {
+	assert.Equal(t, len(actual), len(expected), msg)
+	for i := range expected {
+		assert.Equal(t, actual[i], expected[i], msg)
+	}
+}
+
+func TestSFUConfLifecycle(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+
+	err := sfu.CreateConf(2, ConfOptions{MaxClients: 2})
+	assert.NotError(t, err, "Failed to create conference")
+
+	err = sfu.CreateConf(1, ConfOptions{})
+	assert.NotError(t, err, "Failed to create conference")
+
+	err = sfu.CreateConf(1, ConfOptions{})
+	assert.True(t, err != nil, "Created a duplicate conference")
+
+	confIDs := sfu.Conferences()
+	assert.Equal(t, len(confIDs), 2, "Wrong number of conferences")
+	assert.Equal(t, confIDs[0], ConfID(1), "Conferences out of order")
+	assert.Equal(t, confIDs[1], ConfID(2), "Conferences out of order")
+
+	info, err := sfu.Inspect(2)
+	assert.NotError(t, err, "Failed to inspect conference")
+	assert.Equal(t, info.ID, ConfID(2), "Wrong conference ID")
+	assert.Equal(t, info.Options.MaxClients, 2, "Options not preserved")
+	assert.Equal(t, len(info.Members), 0, "New conference is not empty")
+
+	_, err = sfu.Inspect(3)
+	assert.True(t, err != nil, "Inspected an unknown conference")
+
+	// Adding to an unknown conference creates it
+	err = sfu.AddClient(3, 30)
+	assert.NotError(t, err, "Failed to add client")
+	assert.Equal(t, len(sfu.Conferences()), 3, "Conference not created on add")
+
+	err = sfu.DestroyConf(3)
+	assert.NotError(t, err, "Failed to destroy conference")
+	assert.Equal(t, len(sfu.Conferences()), 2, "Conference not destroyed")
+	assert.Equal(t, len(sfu.Members(3)), 0, "Destroyed conference has members")
+	_, ok := sfu.ClientConf(30)
+	assert.True(t, !ok, "Client still in destroyed conference")
+
+	err = sfu.DestroyConf(3)
+	assert.True(t, err != nil, "Destroyed an unknown conference")
+}
+
+func TestSFUAddRemove(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+	sfu.CreateConf(1, ConfOptions{MaxClients: 2})
+
+	assert.NotError(t, sfu.AddClient(1, 11), "Failed to add client")
+	assert.NotError(t, sfu.AddClient(1, 10), "Failed to add client")
+	assert.NotError(t, sfu.AddClient(1, 10), "Re-adding a member failed")
+	assertClientIDs(t, sfu.Members(1), []ClientID{10, 11}, "Wrong members")
+
+	err := sfu.AddClient(1, 12)
+	assert.True(t, err != nil, "Added client to a full conference")
+
+	// Moving a client removes it from its old conference
+	assert.NotError(t, sfu.AddClient(2, 11), "Failed to move client")
+	assertClientIDs(t, sfu.Members(1), []ClientID{10}, "Client not removed from old conference")
+	assertClientIDs(t, sfu.Members(2), []ClientID{11}, "Client not added to new conference")
+
+	confID, ok := sfu.ClientConf(11)
+	assert.True(t, ok, "Client not in any conference")
+	assert.Equal(t, confID, ConfID(2), "Client in wrong conference")
+
+	err = sfu.RemoveClient(1, 11)
+	assert.True(t, err != nil, "Removed client from a conference it is not in")
+	assertClientIDs(t, sfu.Members(2), []ClientID{11}, "Client removed from wrong conference")
+
+	assert.NotError(t, sfu.RemoveClient(2, 11), "Failed to remove client")
+	assertClientIDs(t, sfu.Members(2), []ClientID{}, "Client not removed")
+	assert.Equal(t, len(sfu.GetFibEntry(11, 0)), 0, "Removed client still forwarded")
+}
+
+func TestSFUStopConf(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+	for i := 1; i <= 3; i += 1 {
+		sfu.AddClient(1, ClientID(i))
+	}
+	sfu.UpdateEnergy(1, -10, true)
+
+	sfu.StopConf(1)
+	assertClientIDs(t, sfu.Members(1), []ClientID{}, "Stopped conference has members")
+	assert.Equal(t, len(sfu.Conferences()), 1, "Stopped conference was destroyed")
+	assert.Equal(t, sfu.ActiveSpeakers(1)[0], ClientID(0), "Stopped conference has speakers")
+	assert.Equal(t, len(sfu.GetFibEntry(1, testAudioPTList[0])), 0, "Stopped conference still forwards")
+
+	// The conference can be re-used after it is stopped
+	assert.NotError(t, sfu.AddClient(1, 4), "Failed to add client to stopped conference")
+	assertClientIDs(t, sfu.Members(1), []ClientID{4}, "Wrong members")
+}
+
+func TestSFUMute(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+	sfu.AddClient(1, 1)
+	sfu.AddClient(1, 2)
+
+	sfu.Mute(1, true)
+	assert.True(t, sfu.IsMuted(1), "Client not muted")
+	assert.True(t, !sfu.IsMuted(2), "Wrong client muted")
+
+	info, err := sfu.Inspect(1)
+	assert.NotError(t, err, "Failed to inspect conference")
+	assertClientIDs(t, info.Muted, []ClientID{1}, "Wrong muted list")
+
+	sfu.Mute(1, false)
+	assert.True(t, !sfu.IsMuted(1), "Client not unmuted")
+
+	// Mute state does not survive leaving the conference
+	sfu.Mute(2, true)
+	sfu.RemoveClient(1, 2)
+	sfu.AddClient(1, 2)
+	assert.True(t, !sfu.IsMuted(2), "Mute state survived removal")
+
+	// ... but it does survive moving to another conference
+	sfu.ServerMute(2, true, true)
+	sfu.AddClient(2, 2)
+	state := sfu.MuteState(2)
+	assert.True(t, state.ServerAudio && state.ServerVideo, "Server mute lost in a move")
+}
+
+func TestSFUMuteForwarding(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+	sfu.AddClient(1, 1)
+	sfu.AddClient(1, 2)
+	events := sfu.Subscribe(1)
+
+	// A muted client can't become a speaker
+	sfu.Mute(1, true)
+	sfu.UpdateEnergy(1, -10, true)
+	sfu.UpdateEnergy(2, -20, true)
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{2, 0}, "Muted client became a speaker")
+
+	event := nextEvent(t, events, EventMute)
+	assert.Equal(t, event.ClientID, ClientID(1), "Wrong client in mute event")
+	assert.True(t, event.Mute.ServerAudio, "Mute event without server mute")
+
+	// Muting a speaker drops it, and its audio
+	sfu.SelfMute(2, true, false)
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{0, 0}, "Muted speaker not dropped")
+	assert.Equal(t, len(sfu.GetFibEntry(2, testAudioPTList[0])), 0, "Muted audio forwarded")
+	event = nextEvent(t, events, EventMute)
+	assert.True(t, event.Mute.SelfAudio && !event.Mute.Video(), "Wrong self mute event")
+
+	// Audio and video mute separately; self and server mute separately
+	sfu.SelfMute(2, false, true)
+	sfu.UpdateEnergy(2, -20, true)
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{2, 0}, "Unmuted client not a speaker")
+	assert.Equal(t, len(sfu.GetFibEntry(2, testAudioPTList[0])), 1, "Unmuted audio not forwarded")
+	assert.Equal(t, len(sfu.GetFibEntry(2, 0)), 0, "Muted video forwarded")
+
+	sfu.Mute(1, false)
+	assert.True(t, !sfu.IsMuted(1), "Client still muted")
+	sfu.ServerMute(1, true, true)
+	sfu.SelfMute(1, false, false)
+	assert.True(t, sfu.MuteState(1).Audio() && sfu.MuteState(1).Video(), "Client unmuted a server mute")
+
+	info, err := sfu.Inspect(1)
+	assert.NotError(t, err, "Failed to inspect conference")
+	assertClientIDs(t, info.Muted, []ClientID{1}, "Wrong muted list")
+	assertClientIDs(t, info.NoVideo, []ClientID{1, 2}, "Wrong video muted list")
+
+	sfu.Unsubscribe(events)
+	for range events {
+	}
+}
+
+func TestSFUNoAudio(t *testing.T) {
+	sfu := NewSFU(nil)
+	sfu.AddClient(1, 1)
+	sfu.AddClient(1, 2)
+	sfu.UpdateEnergy(1, -10, true)
+	sfu.SetVideoLayout(2, VideoLayout{Pin: 1})
+
+	// Everything is video
+	assert.Equal(t, len(sfu.ActiveSpeakers(1)), 0, "Speakers without audio")
+	assert.Equal(t, len(sfu.GetFibEntry(1, 109)), 1, "Video not forwarded")
+
+	err := sfu.RemoveClient(1, 1)
+	assert.NotError(t, err, "Failed to remove client")
+	assert.Equal(t, len(sfu.GetFibEntry(1, 109)), 0, "Removed client still forwarded")
+}
+
+func TestSFUForwarding(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+	for i := 1; i <= 3; i += 1 {
+		sfu.AddClient(1, ClientID(i))
+	}
+
+	// Client 1 becomes the active speaker
+	sfu.UpdateEnergy(1, -10, true)
+	assert.Equal(t, sfu.ActiveSpeakers(1)[0], ClientID(1), "Wrong active speaker")
+
+	audio := sfu.GetFibEntry(1, testAudioPTList[0])
+	assert.Equal(t, len(audio), 2, "Active speaker audio not sent to everyone else")
+	for _, dest := range audio {
+		assert.NotEqual(t, dest.clientID, ClientID(1), "Audio looped back to sender")
+		assert.Equal(t, dest.pt, testAudioPTList[0], "Wrong audio slot")
+	}
+
+	video := sfu.GetFibEntry(1, 120)
+	assert.Equal(t, len(video), 2, "Active speaker video not sent to everyone else")
+
+	assert.Equal(t, len(sfu.GetFibEntry(2, testAudioPTList[0])), 0, "Non-speaker audio forwarded")
+	assert.Equal(t, len(sfu.GetFibEntry(2, 120)), 0, "Non-speaker video forwarded")
+}
+
+func TestSFUBandwidth(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+	sfu.AddClient(1, 1)
+
+	_, ok := sfu.Bandwidth(1)
+	assert.True(t, !ok, "Bandwidth known before it was set")
+
+	sfu.SetBandwidth(1, 500000)
+	bps, ok := sfu.Bandwidth(1)
+	assert.True(t, ok, "Bandwidth not set")
+	assert.Equal(t, bps, uint64(500000), "Wrong bandwidth")
+
+	sfu.RemoveClient(1, 1)
+	_, ok = sfu.Bandwidth(1)
+	assert.True(t, !ok, "Bandwidth survived removal")
+}
+
+func TestSFUSimulcastLayers(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+	for i := 1; i <= 3; i += 1 {
+		sfu.AddClient(1, ClientID(i))
+	}
+	sfu.UpdateEnergy(1, -10, true)
+
+	layerFor := func(clientID ClientID) int {
+		for _, dest := range sfu.GetFibEntry(1, 120) {
+			if dest.clientID == clientID {
+				return dest.layer
+			}
+		}
+		t.Fatalf("No video for client [%v]", clientID)
+		return -1
+	}
+
+	// Everyone gets the top layer of the main view by default
+	sfu.SetLayers(1, []uint64{100000, 500000, 2000000})
+	assert.Equal(t, layerFor(2), 2, "Main view not on the highest layer")
+	assert.Equal(t, layerFor(3), 2, "Main view not on the highest layer")
+
+	// ... unless it doesn't fit
+	sfu.SetBandwidth(2, 600000)
+	sfu.SetBandwidth(3, 50000)
+	assert.Equal(t, layerFor(2), 1, "Layer not limited by bandwidth")
+	assert.Equal(t, layerFor(3), 0, "Lowest layer not used as a last resort")
+
+	assert.Equal(t, sfu.chooseLayer(1, 2, false), 0, "Thumbnail not on the lowest layer")
+	assert.Equal(t, sfu.chooseLayer(2, 1, true), 0, "Layer chosen for a sender without simulcast")
+}
+
+func TestSFUTemporalLayers(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+	for i := 1; i <= 3; i += 1 {
+		sfu.AddClient(1, ClientID(i))
+	}
+	sfu.UpdateEnergy(1, -10, true)
+	sfu.SetLayers(1, []uint64{400000})
+
+	maxTID := func(clientID ClientID) uint8 {
+		for _, dest := range sfu.GetFibEntry(1, 120) {
+			if dest.clientID == clientID {
+				return dest.maxTID
+			}
+		}
+		t.Fatalf("No video for client [%v]", clientID)
+		return 0
+	}
+
+	assert.Equal(t, maxTID(2), uint8(MaxTemporalLayer), "Video thinned without a reason")
+
+	sfu.SetBandwidth(2, 300000)
+	sfu.SetBandwidth(3, 100000)
+	assert.Equal(t, maxTID(2), uint8(1), "Video not thinned to fit")
+	assert.Equal(t, maxTID(3), uint8(0), "Video not thinned to the base layer")
+
+	assert.Equal(t, sfu.chooseTemporal(1, 2, 0, false), uint8(0), "Thumbnail not thinned")
+}
+
+func TestSFULastN(t *testing.T) {
+	sfu := NewSFU([]int8{109, 110, 111})
+	err := sfu.CreateConf(2, ConfOptions{NumSpeakers: 4})
+	assert.True(t, err != nil, "More speakers than audio slots")
+
+	err = sfu.CreateConf(1, ConfOptions{NumSpeakers: 3})
+	assert.NotError(t, err, "Failed to create conference")
+	for i := 1; i <= 5; i += 1 {
+		sfu.AddClient(1, ClientID(i))
+	}
+
+	// Speakers fill empty slots in turn
+	sfu.UpdateEnergy(1, -10, true)
+	sfu.UpdateEnergy(2, -20, true)
+	sfu.UpdateEnergy(3, -25, true)
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{1, 2, 3}, "Wrong speakers")
+
+	// A slightly louder client doesn't take a slot; a clearly louder one
+	// takes the quietest
+	sfu.UpdateEnergy(4, -22, true)
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{1, 2, 3}, "Speaker replaced without hysteresis")
+	sfu.UpdateEnergy(5, -12, true)
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{1, 2, 5}, "Louder speaker not mixed in")
+
+	// Each speaker's audio goes in its own slot
+	for i, speaker := range []ClientID{1, 2, 5} {
+		dests := sfu.GetFibEntry(speaker, 109)
+		assert.Equal(t, len(dests), 4, "Speaker audio not sent to everyone else")
+		assert.Equal(t, dests[0].pt, int8(109+i), "Wrong audio slot")
+	}
+	assert.Equal(t, len(sfu.GetFibEntry(3, 109)), 0, "Former speaker audio forwarded")
+
+	// A new active speaker moves the old one to the previous speaker's
+	// slot, which takes the new one's
+	sfu.mu.Lock()
+	sfu.confMap[1].activeSpeakerStartTime = time.Time{}
+	sfu.mu.Unlock()
+	sfu.UpdateEnergy(5, -3, true)
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{5, 1, 2}, "Wrong speakers after switch")
+
+	// A speaker that leaves gives its slot to the loudest other client
+	sfu.RemoveClient(1, 1)
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{5, 4, 2}, "Removed client still a speaker")
+
+	// One speaker is enough
+	sfu.CreateConf(3, ConfOptions{NumSpeakers: 1})
+	sfu.AddClient(3, 6)
+	sfu.AddClient(3, 7)
+	sfu.UpdateEnergy(6, -10, true)
+	sfu.UpdateEnergy(7, -11, true)
+	assertClientIDs(t, sfu.ActiveSpeakers(3), []ClientID{6}, "Wrong single speaker")
+	assert.Equal(t, len(sfu.GetFibEntry(7, 109)), 0, "Non-speaker audio forwarded")
+}
+
+func TestSFUVideoLayout(t *testing.T) {
+	sfu := NewSFU(testAudioPTList)
+	for i := 1; i <= 4; i += 1 {
+		sfu.AddClient(1, ClientID(i))
+	}
+	sfu.UpdateEnergy(1, -10, true)
+	sfu.UpdateEnergy(2, -20, true)
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{1, 2}, "Wrong speakers")
+
+	// The view a source's video goes in for a receiver, or -1
+	view := func(src, dest ClientID) int {
+		for _, d := range sfu.GetFibEntry(src, 0) {
+			if d.clientID == dest {
+				return d.view
+			}
+		}
+		return -1
+	}
+
+	// By default, video follows the speaker
+	assert.Equal(t, view(1, 3), 0, "Active speaker not in main view")
+	assert.Equal(t, view(2, 1), 0, "Previous speaker not in active speaker's main view")
+	assert.Equal(t, view(2, 3), -1, "Previous speaker shown without thumbnails")
+
+	// A pinned client takes the main view, and thumbnails show the speakers
+	err := sfu.SetVideoLayout(3, VideoLayout{Pin: 4, Thumbnails: 2})
+	assert.NotError(t, err, "Failed to set layout")
+	assert.Equal(t, view(4, 3), 0, "Pinned client not in main view")
+	assert.Equal(t, view(1, 3), 1, "Active speaker not in first thumbnail")
+	assert.Equal(t, view(2, 3), 2, "Previous speaker not in second thumbnail")
+	assert.Equal(t, view(1, 4), 0, "Layout changed for another client")
+
+	for _, d := range sfu.GetFibEntry(1, 0) {
+		if d.clientID == 3 {
+			assert.Equal(t, d.maxTID, uint8(0), "Thumbnail got upper temporal layers")
+		}
+	}
+
+	// Without the pinned client, the main view follows the speaker again
+	sfu.ServerMute(4, false, true)
+	assert.Equal(t, view(1, 3), 0, "Main view not back to the speaker")
+	assert.Equal(t, view(2, 3), 1, "Thumbnails not moved up")
+	sfu.ServerMute(4, false, false)
+	assert.Equal(t, view(4, 3), 0, "Pin not restored")
+
+	err = sfu.SetVideoLayout(3, VideoLayout{Pin: 5})
+	assert.True(t, err != nil, "Pinned a client outside the conference")
+	err = sfu.SetVideoLayout(3, VideoLayout{Thumbnails: MaxThumbnails + 1})
+	assert.True(t, err != nil, "Too many thumbnails")
+	err = sfu.SetVideoLayout(5, VideoLayout{})
+	assert.True(t, err != nil, "Layout for a client outside a conference")
+	assert.Equal(t, sfu.VideoLayout(3), VideoLayout{Pin: 4, Thumbnails: 2}, "Layout changed by a failed update")
+}
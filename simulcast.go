@@ -0,0 +1,230 @@
+package percy
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// Simulcast.  A sender can send its video as several layers of different
+// quality, each on its own SSRC and identified by a RID header extension.
+// The layers are all in one media section, identified by the MID header
+// extension; video the sender has in another section (e.g., a screen
+// share) isn't one of the layers.
+// The MD measures each layer's bitrate and reports the layers to the SFU,
+// which picks a layer for each receiver (see SFU.chooseLayer).  Video
+// without simulcast is reported as a single layer.
+//
+// The MD can't move a layer onto a stable SSRC, so a receiver sees each
+// layer as a separate stream.  It only switches a receiver to a new layer
+// on a keyframe: until one arrives it keeps forwarding the old layer, and
+// asks the sender for a keyframe on the new one.
+//
+// https://tools.ietf.org/html/rfc8853
+// https://tools.ietf.org/html/rfc8852#section-3.1
+
+var defaultSimulcastRIDs = []string{"q", "h", "f"}
+
+type simulcastLayer struct {
+	ssrc    uint32
+	rid     string
+	rank    int
+	bitrate uint64
+}
+
+// The simulcast layers from one sender, lowest first
+type simulcastSender struct {
+	mid    string // the media section the layers are in, if known
+	layers []*simulcastLayer
+}
+
+// The layer a sender's SSRC carries, or -1 if it isn't a layer
+func (sim *simulcastSender) layer(ssrc uint32) int {
+	for i, layer := range sim.layers {
+		if layer.ssrc == ssrc {
+			return i
+		}
+	}
+	return -1
+}
+
+// The SSRC for the layer the SFU asked for, or the nearest one
+func (sim *simulcastSender) ssrc(layer int) uint32 {
+	if layer >= len(sim.layers) {
+		layer = len(sim.layers) - 1
+	}
+	if layer < 0 {
+		layer = 0
+	}
+	return sim.layers[layer].ssrc
+}
+
+func (sim *simulcastSender) bitrates() []uint64 {
+	bitrates := make([]uint64, len(sim.layers))
+	for i, layer := range sim.layers {
+		bitrates[i] = layer.bitrate
+	}
+	return bitrates
+}
+
+// Tell the MDD the RIDs it will see on simulcast layers, lowest quality
+// first (a=simulcast)
+func (mdd *MDD) SetSimulcastRIDs(rids []string) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	mdd.simulcastRIDs = append([]string{}, rids...)
+}
+
+// Note a video packet from a sender, learning which SSRC carries which
+// layer from the RID and MID extensions.  Returns the sender's simulcast
+// state, or nil if the packet isn't part of its simulcast.
+func (mdd *MDD) simulcastPacket(src mediaSource, hdr *rtpHeader) *simulcastSender {
+	mid := string(mdd.extension(hdr, ExtensionMID))
+	if sim, ok := mdd.simulcast[src.assocID]; ok && len(mid) > 0 && len(sim.mid) > 0 && mid != sim.mid {
+		return nil
+	}
+
+	if rid := mdd.extension(hdr, ExtensionRID); len(rid) > 0 {
+		return mdd.addLayer(src, mid, string(rid))
+	}
+
+	// Only the first packets on a layer need carry the RID
+	if sim, ok := mdd.simulcast[src.assocID]; ok && sim.layer(src.ssrc) >= 0 {
+		return sim
+	}
+	return nil
+}
+
+// The value of a header extension on a packet, or nil
+func (mdd *MDD) extension(hdr *rtpHeader, uri string) []byte {
+	id, ok := mdd.extensions[uri]
+	if !ok {
+		return nil
+	}
+	return hdr.extensions[id]
+}
+
+func (mdd *MDD) addLayer(src mediaSource, mid, rid string) *simulcastSender {
+	sim, ok := mdd.simulcast[src.assocID]
+	if !ok {
+		sim = &simulcastSender{}
+		mdd.simulcast[src.assocID] = sim
+	}
+	if len(sim.mid) == 0 {
+		sim.mid = mid
+	}
+
+	if sim.layer(src.ssrc) >= 0 {
+		return sim
+	}
+
+	// RIDs the MD doesn't know about rank below the ones it does
+	rank := -1
+	for i, known := range mdd.simulcastRIDs {
+		if rid == known {
+			rank = i
+		}
+	}
+	if rank < 0 {
+		log.Printf("Unknown simulcast RID from [%04x]: %q", src.assocID, rid)
+	}
+
+	sim.layers = append(sim.layers, &simulcastLayer{ssrc: src.ssrc, rid: rid, rank: rank})
+	sort.SliceStable(sim.layers, func(i, j int) bool { return sim.layers[i].rank < sim.layers[j].rank })
+
+	mdd.SFU.SetLayers(ClientID(src.assocID), sim.bitrates())
+	return sim
+}
+
+// Measure each sender's video, and tell the SFU
+func (mdd *MDD) updateLayers(now time.Time) {
+	mdd.mu.Lock()
+	defer mdd.mu.Unlock()
+
+	// Video from senders without simulcast is one layer
+	video := map[AssociationID]uint64{}
+	for src, stats := range mdd.recvStats {
+		if stats.clockRate != videoClockRate {
+			continue
+		}
+
+		bitrate := stats.bitrate(now)
+		if sim, ok := mdd.simulcast[src.assocID]; ok {
+			if i := sim.layer(src.ssrc); i >= 0 {
+				sim.layers[i].bitrate = bitrate
+			}
+			continue
+		}
+		video[src.assocID] += bitrate
+	}
+
+	if mdd.SFU == nil {
+		return
+	}
+
+	for assocID, sim := range mdd.simulcast {
+		mdd.SFU.SetLayers(ClientID(assocID), sim.bitrates())
+	}
+	for assocID, bitrate := range video {
+		mdd.SFU.SetLayers(ClientID(assocID), []uint64{bitrate})
+	}
+}
+
+// Forget about layers a sender has said BYE for
+func (mdd *MDD) removeLayer(src mediaSource) {
+	sim, ok := mdd.simulcast[src.assocID]
+	if !ok {
+		return
+	}
+
+	i := sim.layer(src.ssrc)
+	if i < 0 {
+		return
+	}
+
+	sim.layers = append(sim.layers[:i], sim.layers[i+1:]...)
+	if len(sim.layers) == 0 {
+		delete(mdd.simulcast, src.assocID)
+	}
+
+	if mdd.SFU != nil {
+		mdd.SFU.SetLayers(ClientID(src.assocID), sim.bitrates())
+	}
+}
+
+// Whether a packet from a simulcast layer should go to a receiver.  The
+// receiver stays on the layer it has until the layer the SFU wants for it
+// has a keyframe (or, without frame marking, as soon as that layer sends
+// anything).
+func (mdd *MDD) forwardLayer(client *mddClient, src mediaSource, sim *simulcastSender, dest Destination, keyframe, marked bool, now time.Time) bool {
+	if client.layers == nil {
+		client.layers = map[AssociationID]uint32{}
+	}
+
+	target := sim.ssrc(dest.layer)
+	current, ok := client.layers[src.assocID]
+	if ok && current == target {
+		return src.ssrc == current
+	}
+
+	switch src.ssrc {
+	case target:
+		if !keyframe {
+			mdd.requestKeyframe(mediaSource{src.assocID, target}, now)
+		}
+
+		if keyframe || !marked {
+			client.layers[src.assocID] = target
+			return true
+		}
+		return false
+
+	case current:
+		mdd.requestKeyframe(mediaSource{src.assocID, target}, now)
+		return ok
+
+	default:
+		return false
+	}
+}
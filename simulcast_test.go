@@ -0,0 +1,138 @@
+package percy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+// A video header carrying a RID (ID=3)
+func ridHeader(ssrc uint32, rid string) *rtpHeader {
+	return &rtpHeader{ssrc: ssrc, extensions: map[uint8][]byte{3: []byte(rid)}}
+}
+
+func TestSimulcastLayers(t *testing.T) {
+	mdd := NewMDD()
+	mdd.SFU = NewSFU(testAudioPTList)
+	mdd.SFU.AddClient(1, 1)
+	mdd.SetExtensionID(ExtensionRID, 3)
+
+	now := time.Now()
+	for i, rid := range []string{"f", "q", "x", "h"} {
+		src := mediaSource{assocID: 1, ssrc: uint32(i + 1)}
+		sim := mdd.simulcastPacket(src, ridHeader(src.ssrc, rid))
+		assert.True(t, sim != nil, "Simulcast not detected")
+
+		stats := newReceiverStats(0, videoClockRate)
+		stats.update(0, 0, now)
+		stats.bytes = uint64(1000 * (i + 1))
+		mdd.recvStats[src] = stats
+	}
+
+	// Layers are in RID order, with unknown RIDs lowest
+	sim := mdd.simulcast[1]
+	assert.Equal(t, len(sim.layers), 4, "Wrong number of layers")
+	for i, rid := range []string{"x", "q", "h", "f"} {
+		assert.Equal(t, sim.layers[i].rid, rid, "Layers in the wrong order")
+	}
+	assert.Equal(t, sim.layer(2), 1, "Wrong layer for SSRC")
+	assert.Equal(t, sim.layer(5), -1, "Layer for unknown SSRC")
+	assert.Equal(t, sim.ssrc(7), uint32(1), "Wrong SSRC above the top layer")
+	assert.Equal(t, sim.ssrc(-1), uint32(3), "Wrong SSRC below the bottom layer")
+
+	// Once the MD knows the SSRC, the RID isn't needed
+	src := mediaSource{assocID: 1, ssrc: 2}
+	assert.True(t, mdd.simulcastPacket(src, &rtpHeader{ssrc: 2}) == sim, "Layer not remembered")
+	assert.True(t, mdd.simulcastPacket(mediaSource{assocID: 2, ssrc: 9}, &rtpHeader{ssrc: 9}) == nil,
+		"Simulcast detected without a RID")
+
+	// Video without simulcast is reported as one layer
+	mdd.SFU.AddClient(1, 2)
+	stats := newReceiverStats(0, videoClockRate)
+	stats.update(0, 0, now)
+	stats.bytes = 5000
+	mdd.recvStats[mediaSource{assocID: 2, ssrc: 9}] = stats
+
+	mdd.updateLayers(now.Add(time.Second))
+	for i, bitrate := range []uint64{24000, 16000, 32000, 8000} {
+		assert.Equal(t, sim.layers[i].bitrate, bitrate, "Wrong layer bitrate")
+	}
+
+	mdd.SFU.mu.Lock()
+	layers := mdd.SFU.layerMap[2]
+	mdd.SFU.mu.Unlock()
+	assert.Equal(t, len(layers), 1, "Wrong number of layers without simulcast")
+	assert.Equal(t, layers[0], uint64(40000), "Wrong bitrate without simulcast")
+
+	mdd.mu.Lock()
+	mdd.removeLayer(mediaSource{assocID: 1, ssrc: 3})
+	mdd.mu.Unlock()
+	assert.Equal(t, len(sim.layers), 3, "Layer not removed")
+	assert.Equal(t, sim.layers[0].rid, "q", "Wrong layer removed")
+}
+
+func TestSimulcastMID(t *testing.T) {
+	mdd := NewMDD()
+	mdd.SFU = NewSFU(testAudioPTList)
+	mdd.SFU.AddClient(1, 1)
+	mdd.SetExtensionID(ExtensionRID, 3)
+	mdd.SetExtensionID(ExtensionMID, 4)
+
+	header := func(ssrc uint32, mid, rid string) *rtpHeader {
+		hdr := ridHeader(ssrc, rid)
+		hdr.extensions[4] = []byte(mid)
+		return hdr
+	}
+
+	for i, rid := range []string{"q", "h"} {
+		src := mediaSource{assocID: 1, ssrc: uint32(i + 1)}
+		sim := mdd.simulcastPacket(src, header(src.ssrc, "1", rid))
+		assert.True(t, sim != nil, "Simulcast not detected")
+	}
+	sim := mdd.simulcast[1]
+	assert.Equal(t, sim.mid, "1", "Wrong simulcast MID")
+
+	// Video in another media section isn't a layer, with a RID or without
+	other := mediaSource{assocID: 1, ssrc: 9}
+	assert.True(t, mdd.simulcastPacket(other, header(9, "2", "")) == nil, "Other section treated as simulcast")
+	assert.True(t, mdd.simulcastPacket(other, header(9, "2", "f")) == nil, "Other section added as a layer")
+	assert.Equal(t, len(sim.layers), 2, "Wrong number of layers")
+	assert.True(t, mdd.simulcastPacket(other, &rtpHeader{ssrc: 9}) == nil, "Other section treated as simulcast later")
+}
+
+func TestSimulcastLayerSwitch(t *testing.T) {
+	mdd := NewMDD()
+	client := &mddClient{}
+	sim := &simulcastSender{layers: []*simulcastLayer{{ssrc: 1}, {ssrc: 2}}}
+	low := mediaSource{assocID: 1, ssrc: 1}
+	high := mediaSource{assocID: 1, ssrc: 2}
+	dest := Destination{clientID: 2, layer: 1}
+	now := time.Now()
+
+	forward := func(src mediaSource, keyframe bool) bool {
+		return mdd.forwardLayer(client, src, sim, dest, keyframe, true, now)
+	}
+
+	// Nothing until the wanted layer has a keyframe
+	assert.True(t, !forward(low, false), "Unwanted layer forwarded")
+	assert.True(t, !forward(high, false), "Layer forwarded before a keyframe")
+	_, requested := mdd.keyframeRequests[high]
+	assert.True(t, requested, "No keyframe requested")
+	assert.True(t, forward(high, true), "Keyframe not forwarded")
+	assert.True(t, forward(high, false), "Layer not forwarded after a keyframe")
+	assert.True(t, !forward(low, true), "Unwanted layer forwarded")
+
+	// Switching down keeps the old layer going until the new one has a
+	// keyframe
+	dest.layer = 0
+	assert.True(t, forward(high, false), "Old layer stopped early")
+	assert.True(t, !forward(low, false), "New layer forwarded before a keyframe")
+	assert.True(t, forward(low, true), "Keyframe not forwarded")
+	assert.True(t, !forward(high, false), "Old layer still forwarded")
+
+	// Without frame marking, switches happen straight away
+	dest.layer = 1
+	assert.True(t, mdd.forwardLayer(client, high, sim, dest, false, false, now), "Switch without frame marking")
+	assert.True(t, !mdd.forwardLayer(client, low, sim, dest, false, false, now), "Old layer still forwarded")
+}
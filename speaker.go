@@ -0,0 +1,185 @@
+package percy
+
+import (
+	"math"
+	"time"
+)
+
+// SpeakerPolicy decides how loud each client is, and how readily the SFU
+// changes who the speakers are.  The SFU keeps one EnergyEstimator per
+// client, fed with the audio levels (RFC 6464) from its packets.
+type SpeakerPolicy interface {
+	NewEstimator() EnergyEstimator
+	Thresholds() SpeakerThresholds
+}
+
+type EnergyEstimator interface {
+	Update(dBov int8, vad bool, now time.Time)
+	Energy(now time.Time) float64 // in dBov
+}
+
+// the knobs that decide when speakers change
+type SpeakerThresholds struct {
+	MinEnergy  float64       // energy (dBov) a client needs to be a speaker
+	Hysteresis float64       // how much louder (dB) a client has to be to take a speaker's slot
+	MinDwell   time.Duration // how long an active speaker keeps the floor before it can change
+	StaleAfter time.Duration // how long a speaker can go without sending a level before it loses its slot
+}
+
+func (th SpeakerThresholds) Thresholds() SpeakerThresholds {
+	return th
+}
+
+var DefaultSpeakerThresholds = SpeakerThresholds{
+	MinEnergy:  -35.0,
+	Hysteresis: 6.0,
+	MinDwell:   200 * time.Millisecond,
+	StaleAfter: 2 * time.Second,
+}
+
+//////////
+
+// the original estimator: jumps up to any louder level, decays slowly,
+// and starts over after a gap
+type BaselinePolicy struct {
+	SpeakerThresholds
+}
+
+func NewBaselinePolicy() *BaselinePolicy {
+	return &BaselinePolicy{SpeakerThresholds: DefaultSpeakerThresholds}
+}
+
+func (policy *BaselinePolicy) NewEstimator() EnergyEstimator {
+	return &baselineEstimator{energy: silenceEnergy}
+}
+
+type baselineEstimator struct {
+	energy   float64
+	lastTime time.Time
+}
+
+func (est *baselineEstimator) Update(dBov int8, vad bool, now time.Time) {
+	db := float64(dBov)
+	if now.Sub(est.lastTime) > time.Duration(1500*time.Millisecond) {
+		// just replace old endergy measurements - too old to care
+		est.energy = db
+	} else {
+		est.energy = math.Max(db, 0.2*db+0.8*est.energy)
+	}
+	est.lastTime = now
+}
+
+func (est *baselineEstimator) Energy(now time.Time) float64 {
+	if now.Sub(est.lastTime) > time.Duration(1500*time.Millisecond) {
+		return silenceEnergy
+	}
+	return est.energy
+}
+
+//////////
+
+// a rolling average of the audio power over a window, kept in bins so
+// that old levels drop out on time.  Time with no packets (e.g., DTX)
+// counts as silence, and packets without voice activity count for less.
+type WindowedPolicy struct {
+	SpeakerThresholds
+	Window         time.Duration
+	Bin            time.Duration
+	UnvoicedWeight float64 // 0 ignores packets without voice activity, 1 counts them fully
+}
+
+func NewWindowedPolicy() *WindowedPolicy {
+	return &WindowedPolicy{
+		SpeakerThresholds: DefaultSpeakerThresholds,
+		Window:            2 * time.Second,
+		Bin:               100 * time.Millisecond,
+		UnvoicedWeight:    0.1,
+	}
+}
+
+func (policy *WindowedPolicy) NewEstimator() EnergyEstimator {
+	n := int(policy.Window / policy.Bin)
+	if n < 1 {
+		n = 1
+	}
+
+	return &windowedEstimator{
+		bin:            policy.Bin,
+		unvoicedWeight: policy.UnvoicedWeight,
+		bins:           make([]energyBin, n),
+	}
+}
+
+type energyBin struct {
+	power float64 // linear, summed over the packets in the bin
+	count int
+}
+
+type windowedEstimator struct {
+	bin            time.Duration
+	unvoicedWeight float64
+
+	bins  []energyBin // a ring, with head the current bin
+	head  int
+	start time.Time // when the current bin started
+}
+
+func dBovToPower(db float64) float64 {
+	return math.Pow(10, db/10)
+}
+
+// move on to the bin for now, clearing any that have been skipped
+func (est *windowedEstimator) advance(now time.Time) {
+	if est.start.IsZero() {
+		est.start = now
+		return
+	}
+
+	n := int(now.Sub(est.start) / est.bin)
+	if n <= 0 {
+		return
+	}
+
+	if n >= len(est.bins) {
+		for i := range est.bins {
+			est.bins[i] = energyBin{}
+		}
+	} else {
+		for i := 0; i < n; i += 1 {
+			est.head = (est.head + 1) % len(est.bins)
+			est.bins[est.head] = energyBin{}
+		}
+	}
+	est.start = est.start.Add(time.Duration(n) * est.bin)
+}
+
+func (est *windowedEstimator) Update(dBov int8, vad bool, now time.Time) {
+	est.advance(now)
+
+	power := dBovToPower(float64(dBov))
+	if !vad {
+		power *= est.unvoicedWeight
+	}
+
+	est.bins[est.head].power += power
+	est.bins[est.head].count += 1
+}
+
+func (est *windowedEstimator) Energy(now time.Time) float64 {
+	if est.start.IsZero() {
+		return silenceEnergy
+	}
+	est.advance(now)
+
+	silence := dBovToPower(silenceEnergy)
+	total := 0.0
+	for _, bin := range est.bins {
+		if bin.count == 0 {
+			total += silence
+			continue
+		}
+		total += math.Max(bin.power/float64(bin.count), silence)
+	}
+
+	return 10 * math.Log10(total/float64(len(est.bins)))
+}
@@ -0,0 +1,148 @@
+package percy
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+func TestBaselineEstimator(t *testing.T) {
+	start := time.Now()
+	est := NewBaselinePolicy().NewEstimator()
+	assert.Equal(t, est.Energy(start), silenceEnergy, "Energy before any packets")
+
+	// Jumps up to louder levels, and decays towards quieter ones
+	est.Update(-20, true, start)
+	assert.Equal(t, est.Energy(start), -20.0, "Energy didn't jump up")
+
+	est.Update(-60, true, start.Add(20*time.Millisecond))
+	assert.Equal(t, est.Energy(start), 0.2*-60+0.8*-20, "Energy didn't decay")
+
+	// Starts over after a gap
+	est.Update(-60, true, start.Add(2*time.Second))
+	assert.Equal(t, est.Energy(start), -60.0, "Energy didn't start over")
+}
+
+func TestWindowedEstimator(t *testing.T) {
+	policy := NewWindowedPolicy()
+	policy.Window = time.Second
+	policy.Bin = 100 * time.Millisecond
+	policy.UnvoicedWeight = 0.0
+
+	close := func(a, b float64) bool { return math.Abs(a-b) < 0.01 }
+
+	start := time.Now()
+	est := policy.NewEstimator()
+	assert.Equal(t, est.Energy(start), silenceEnergy, "Energy before any packets")
+
+	// A steady level over the whole window is that level
+	for i := 0; i < 50; i += 1 {
+		est.Update(-20, true, start.Add(time.Duration(i)*20*time.Millisecond))
+	}
+	now := start.Add(990 * time.Millisecond)
+	assert.True(t, close(est.Energy(now), -20.0), "Wrong energy for a steady level")
+
+	// Silence (no packets) counts against the average as it fills the window
+	now = start.Add(1590 * time.Millisecond)
+	assert.True(t, close(est.Energy(now), -20.0+10*math.Log10(0.4)), "Silence not averaged in")
+
+	// ... until the level has dropped out of the window completely
+	now = start.Add(2 * time.Second)
+	assert.True(t, close(est.Energy(now), silenceEnergy), "Old level not dropped")
+
+	// Packets without voice activity count for nothing with a zero weight
+	est.Update(-10, false, now)
+	assert.True(t, close(est.Energy(now), silenceEnergy), "Unvoiced packet counted")
+}
+
+func TestSFUSpeakerPolicy(t *testing.T) {
+	sfu := NewSFU([]int8{109, 110})
+	err := sfu.CreateConf(1, ConfOptions{})
+	assert.NotError(t, err, "Failed to create conference")
+	sfu.AddClient(1, 1)
+	sfu.AddClient(1, 2)
+
+	// A policy with a high threshold keeps a quiet client from speaking
+	policy := NewBaselinePolicy()
+	policy.MinEnergy = -10.0
+	sfu.SetSpeakerPolicy(policy)
+
+	sfu.UpdateEnergy(1, -20, true)
+	assert.Equal(t, sfu.ActiveSpeakers(1)[0], ClientID(0), "Quiet client became a speaker")
+
+	sfu.UpdateEnergy(2, -5, true)
+	assert.Equal(t, sfu.ActiveSpeakers(1)[0], ClientID(2), "Loud client didn't become a speaker")
+}
+
+func TestSFUSpeakerHysteresis(t *testing.T) {
+	sfu := NewSFU([]int8{109, 110})
+	err := sfu.CreateConf(1, ConfOptions{})
+	assert.NotError(t, err, "Failed to create conference")
+	sfu.AddClient(1, 1)
+	sfu.AddClient(1, 2)
+
+	sfu.UpdateEnergy(1, -20, true)
+	assert.Equal(t, sfu.ActiveSpeakers(1)[0], ClientID(1), "First speaker not active")
+
+	// A speaker only a little louder doesn't take over, however long it
+	// goes on
+	now := time.Now()
+	sfu.UpdateEnergy(2, -18, true)
+	sfu.UpdateSpeakers(now.Add(2 * DefaultSpeakerThresholds.MinDwell))
+	sfu.UpdateSpeakers(now.Add(4 * DefaultSpeakerThresholds.MinDwell))
+	assert.Equal(t, sfu.ActiveSpeakers(1)[0], ClientID(1), "Active speaker changed to a similar level")
+
+	// ... but one clearly louder does
+	sfu.UpdateEnergy(2, -10, true)
+	sfu.UpdateSpeakers(now.Add(6 * DefaultSpeakerThresholds.MinDwell))
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{2, 1}, "Louder speaker not active")
+}
+
+func TestSFUSpeakerHysteresisWindowed(t *testing.T) {
+	sfu := NewSFU([]int8{109, 110})
+	err := sfu.CreateConf(1, ConfOptions{})
+	assert.NotError(t, err, "Failed to create conference")
+	sfu.AddClient(1, 1)
+	sfu.AddClient(1, 2)
+
+	policy := NewWindowedPolicy()
+	policy.Window = time.Second
+	policy.Bin = time.Second
+	sfu.SetSpeakerPolicy(policy)
+
+	// Speakers at similar levels don't swap, whichever policy is used
+	now := time.Now()
+	sfu.UpdateEnergy(1, -20, true)
+	sfu.UpdateEnergy(2, -18, true)
+	sfu.UpdateEnergy(1, -20, true)
+	sfu.UpdateSpeakers(now.Add(2 * DefaultSpeakerThresholds.MinDwell))
+	sfu.UpdateEnergy(2, -18, true)
+	sfu.UpdateSpeakers(now.Add(4 * DefaultSpeakerThresholds.MinDwell))
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{1, 2}, "Similar speakers swapped")
+}
+
+func TestSFUSpeakerRollOff(t *testing.T) {
+	sfu := NewSFU([]int8{109, 110})
+	err := sfu.CreateConf(1, ConfOptions{})
+	assert.NotError(t, err, "Failed to create conference")
+	for i := 1; i <= 3; i += 1 {
+		sfu.AddClient(1, ClientID(i))
+	}
+
+	sfu.UpdateEnergy(1, -10, true)
+	sfu.UpdateEnergy(2, -20, true)
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{1, 2}, "Wrong speakers")
+
+	// The previous speaker takes over from an active speaker that leaves
+	sfu.RemoveClient(1, 1)
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{2, 0}, "Removed client still a speaker")
+
+	// Speakers that stop sending roll off without any more packets
+	sfu.UpdateSpeakers(time.Now().Add(DefaultSpeakerThresholds.StaleAfter / 2))
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{2, 0}, "Speaker rolled off too soon")
+	sfu.UpdateSpeakers(time.Now().Add(2 * DefaultSpeakerThresholds.StaleAfter))
+	assertClientIDs(t, sfu.ActiveSpeakers(1), []ClientID{0, 0}, "Stale speaker not rolled off")
+	assert.Equal(t, len(sfu.GetFibEntry(2, 109)), 0, "Stale speaker's audio still forwarded")
+}
@@ -15,6 +15,7 @@ let page = {
   get answerICE() { return document.getElementById("answerICE"); },
   get local() { return document.getElementById("local"); },
   get remote() { return document.getElementById("remote"); },
+  get speakers() { return document.getElementById("speakers"); },
 };
 
 
@@ -39,6 +40,9 @@ function run() {
   var ice_candidate_set;
   var ice_candidate_is_set = new Promise(r => ice_candidate_set = r);
 
+  // Our own client ID, once percy has told us
+  var my_id = 0;
+
   socket.addEventListener('open', (e) => {
     answer_is_set.then((answer) => {
       console.log('Sending SDP to percy');
@@ -57,6 +61,13 @@ function run() {
       console.log("ice-candidates from percy: ", message.data);
       page.answerICE.value = JSON.stringify(message.data, null, 2) + "\n\n";
       ice_candidate_set(message.data);
+    } else if(message.type === "client") {
+      console.log("client ID from percy: ", message.data.id);
+      my_id = message.data.id;
+    } else if(message.type === "event" && message.data.event === "speakers") {
+      let speakers = (message.data.speakers || []).filter(s => s != 0 && s != my_id);
+      page.speakers.textContent = (speakers.length > 0) ? "Speaking: " + speakers.join(", ") : "";
+      page.remote.classList.toggle("speaking", speakers.length > 0);
     }
   })
 
@@ -119,4 +130,5 @@ window.onload = () => {
   page.answer.value = "";
   page.offerICE.value = "";
   page.answerICE.value = "";
+  page.speakers.textContent = "";
 };
@@ -0,0 +1,143 @@
+package percy
+
+import (
+	"time"
+)
+
+// Reception statistics for one source, so that the MD can send its own
+// receiver reports to the sender in place of the ones from the receivers.
+//
+// https://tools.ietf.org/html/rfc3550#appendix-A.1
+// https://tools.ietf.org/html/rfc3550#appendix-A.3
+// https://tools.ietf.org/html/rfc3550#appendix-A.8
+type receiverStats struct {
+	received uint64
+	baseSeq  uint16
+	maxSeq   uint16
+	cycles   uint32
+
+	expectedPrior uint64
+	receivedPrior uint64
+	fractionLost  uint8 // as of the last report
+
+	clockRate uint32
+	start     time.Time
+	transit   int64
+	jitter    float64
+
+	lastSR     uint32 // middle 32 bits of the NTP timestamp
+	lastSRTime time.Time
+
+	bytes    uint64 // received since the last measurement
+	measured time.Time
+}
+
+// RTP clock rates.  Opus always uses 48kHz, and video 90kHz.
+const (
+	audioClockRate = 48000
+	videoClockRate = 90000
+)
+
+func newReceiverStats(seq uint16, clockRate uint32) *receiverStats {
+	return &receiverStats{baseSeq: seq, maxSeq: seq, clockRate: clockRate}
+}
+
+func (stats *receiverStats) update(seq uint16, timestamp uint32, arrival time.Time) {
+	stats.received += 1
+	if stats.received == 1 {
+		stats.start = arrival
+	}
+
+	if delta := seq - stats.maxSeq; delta > 0 && delta < srtpWindowSize {
+		if seq < stats.maxSeq {
+			stats.cycles += 1
+		}
+		stats.maxSeq = seq
+	}
+
+	// Interarrival jitter, in timestamp units.  Only differences in
+	// transit time matter, so arrival times can be relative.
+	since := arrival.Sub(stats.start)
+	rate := int64(stats.clockRate)
+	arrivalTS := int64(since/time.Second)*rate + int64(since%time.Second)*rate/int64(time.Second)
+	transit := arrivalTS - int64(timestamp)
+	if stats.received > 1 {
+		// RTP timestamps wrap
+		d := int64(int32(transit - stats.transit))
+		if d < 0 {
+			d = -d
+		}
+		stats.jitter += (float64(d) - stats.jitter) / 16
+	}
+	stats.transit = transit
+}
+
+// The bitrate received since the last measurement
+func (stats *receiverStats) bitrate(now time.Time) uint64 {
+	since := stats.measured
+	if since.IsZero() {
+		since = stats.start
+	}
+
+	bytes := stats.bytes
+	stats.bytes = 0
+	stats.measured = now
+
+	period := now.Sub(since)
+	if period <= 0 {
+		return 0
+	}
+	return uint64(float64(bytes*8) / period.Seconds())
+}
+
+// Remember when the sender last sent a report, for LSR and DLSR
+func (stats *receiverStats) senderReport(ntpTime uint64, now time.Time) {
+	stats.lastSR = uint32(ntpTime >> 16)
+	stats.lastSRTime = now
+}
+
+func (stats *receiverStats) extendedMax() uint32 {
+	return stats.cycles<<16 | uint32(stats.maxSeq)
+}
+
+func (stats *receiverStats) report(ssrc uint32, now time.Time) reportBlock {
+	expected := uint64(stats.extendedMax()) - uint64(stats.baseSeq) + 1
+	lost := int64(expected) - int64(stats.received)
+
+	expectedInterval := expected - stats.expectedPrior
+	receivedInterval := stats.received - stats.receivedPrior
+	lostInterval := int64(expectedInterval) - int64(receivedInterval)
+	stats.expectedPrior = expected
+	stats.receivedPrior = stats.received
+
+	var fraction uint8
+	if expectedInterval > 0 && lostInterval > 0 {
+		fraction = 0xff
+		if lostInterval < int64(expectedInterval) {
+			fraction = uint8((lostInterval << 8) / int64(expectedInterval))
+		}
+	}
+	stats.fractionLost = fraction
+
+	// Cumulative loss is a signed 24-bit value
+	if lost > 0x7fffff {
+		lost = 0x7fffff
+	} else if lost < -0x800000 {
+		lost = -0x800000
+	}
+
+	rb := reportBlock{
+		ssrc:           ssrc,
+		fractionLost:   fraction,
+		cumulativeLost: uint32(lost) & 0xffffff,
+		highestSeq:     stats.extendedMax(),
+		jitter:         uint32(stats.jitter),
+		lsr:            stats.lastSR,
+	}
+
+	// Delay since the last SR, in units of 1/65536 seconds
+	if !stats.lastSRTime.IsZero() {
+		rb.dlsr = uint32(now.Sub(stats.lastSRTime) * 65536 / time.Second)
+	}
+	return rb
+}
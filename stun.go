@@ -1,6 +1,7 @@
 package percy
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/hex"
@@ -274,7 +275,8 @@ func (msg STUNMessage) String() string {
 }
 
 func ParseSTUN(msg []byte) (*STUNMessage, error) {
-	// TODO: validate MESSAGE-INTEGRITY and FINGERPRINT -- see RFC5245 §7.2
+	// MESSAGE-INTEGRITY and FINGERPRINT are checked separately, since the
+	// password depends on the USERNAME -- see RFC5245 §7.2
 	request := STUNMessage{}
 
 	used, err := syntax.Unmarshal(msg, &request.header)
@@ -358,6 +360,70 @@ func (msg *STUNMessage) Serialize() ([]byte, error) {
 	return result, err
 }
 
+// Returns the value of the first attribute of the given type
+func (msg *STUNMessage) Get(tag STUNAttrType) ([]byte, bool) {
+	for _, attr := range msg.attributes {
+		if attr.Tag == tag {
+			return attr.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Find the offset of the first attribute of the given type in a raw message
+func findSTUNAttribute(raw []byte, tag STUNAttrType) (int, bool) {
+	offset := STUN_HEADER_SIZE
+	for offset+4 <= len(raw) {
+		attrTag := STUNAttrType(uint16(raw[offset])<<8 | uint16(raw[offset+1]))
+		if attrTag == tag {
+			return offset, true
+		}
+
+		attrLen := int(raw[offset+2])<<8 | int(raw[offset+3])
+		offset += 4 + ((attrLen+3)/4)*4
+	}
+	return 0, false
+}
+
+// Verify the MESSAGE-INTEGRITY attribute of a raw STUN message
+// https://tools.ietf.org/html/rfc5389#section-15.4
+func CheckMessageIntegrity(raw []byte, password string) error {
+	offset, ok := findSTUNAttribute(raw, ATTR_MESSAGE_INTEGRITY)
+	if !ok || offset+24 > len(raw) {
+		return fmt.Errorf("No MESSAGE-INTEGRITY attribute")
+	}
+
+	// The HMAC covers everything before the attribute, with the length
+	// field adjusted to end at the attribute
+	covered := make([]byte, offset)
+	copy(covered, raw[:offset])
+	covered[2] = byte((offset - STUN_HEADER_SIZE + 24) >> 8)
+	covered[3] = byte((offset - STUN_HEADER_SIZE + 24) & 0xFF)
+
+	mac := hmac.New(sha1.New, []byte(password))
+	mac.Write(covered)
+	if !hmac.Equal(mac.Sum(nil), raw[offset+4:offset+24]) {
+		return fmt.Errorf("MESSAGE-INTEGRITY check failed")
+	}
+	return nil
+}
+
+// Verify the FINGERPRINT attribute of a raw STUN message
+// https://tools.ietf.org/html/rfc5389#section-15.5
+func CheckFingerprint(raw []byte) error {
+	offset, ok := findSTUNAttribute(raw, ATTR_FINGERPRINT)
+	if !ok || offset+8 > len(raw) {
+		return fmt.Errorf("No FINGERPRINT attribute")
+	}
+
+	IEEETable := crc32.MakeTable(crc32.IEEE)
+	checksum := crc32.Checksum(raw[:offset], IEEETable)
+	if !bytes.Equal(u32intToBytes(checksum^0x5354554e), raw[offset+4:offset+8]) {
+		return fmt.Errorf("FINGERPRINT check failed")
+	}
+	return nil
+}
+
 func (msg *STUNMessage) Add(tag STUNAttrType, value []byte) {
 	attr := STUNAttribute{Tag: tag, Value: value}
 	msg.attributes = append(msg.attributes, attr)
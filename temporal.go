@@ -0,0 +1,41 @@
+package percy
+
+// Temporal layer dropping.  A video stream coded with temporal scalability
+// (e.g., VP8 or VP9 with several TIDs) can be thinned to a lower frame
+// rate by dropping the frames in the upper temporal layers, which nothing
+// in the lower layers depends on.  The MD can't see the codec payload, so
+// it relies on frame marking for each packet's TID.
+//
+// Dropped packets leave a gap in what the MD forwards, which the
+// sequence number rewriting in rewrite.go closes, recording the sender's
+// sequence numbers in the OHB.
+//
+// Changes to the highest TID a receiver gets only take effect at the start
+// of a frame, so that it never gets part of a frame.  Dropping layers can
+// happen on any frame; adding them has to wait for a frame that only
+// depends on the base layer (B) or on nothing (I).
+//
+// https://tools.ietf.org/html/rfc9626#section-3.1
+
+// Whether a packet with the given frame marking should go to this client,
+// which the SFU says should get temporal layers up to maxTID
+func (client *mddClient) forwardTemporal(src mediaSource, fm frameMarking, maxTID uint8) bool {
+	if client.temporal == nil {
+		client.temporal = map[mediaSource]uint8{}
+	}
+
+	current, ok := client.temporal[src]
+	if !ok {
+		current = maxTID
+		client.temporal[src] = current
+	}
+
+	if fm.start && maxTID != current {
+		if maxTID < current || fm.independent || fm.baseSync {
+			current = maxTID
+			client.temporal[src] = current
+		}
+	}
+
+	return fm.tid <= current
+}
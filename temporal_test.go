@@ -0,0 +1,32 @@
+package percy
+
+import (
+	"testing"
+
+	"github.com/bifurcation/percy/assert"
+)
+
+func TestForwardTemporal(t *testing.T) {
+	client := &mddClient{}
+	src := mediaSource{assocID: 1, ssrc: 0x0b0c0d0e}
+
+	frame := func(tid uint8) frameMarking { return frameMarking{start: true, tid: tid} }
+	middle := func(tid uint8) frameMarking { return frameMarking{tid: tid} }
+
+	// L1T3: TID 0, 2, 1, 2, ...
+	assert.True(t, client.forwardTemporal(src, frame(0), 1), "Base layer dropped")
+	assert.True(t, !client.forwardTemporal(src, frame(2), 1), "Top layer forwarded")
+	assert.True(t, client.forwardTemporal(src, frame(1), 1), "Middle layer dropped")
+
+	// Dropping a layer waits for the next frame
+	assert.True(t, client.forwardTemporal(src, frame(1), 1), "Middle layer dropped")
+	assert.True(t, client.forwardTemporal(src, middle(1), 0), "Frame cut short")
+	assert.True(t, !client.forwardTemporal(src, frame(1), 0), "Middle layer forwarded")
+	assert.True(t, client.forwardTemporal(src, frame(0), 0), "Base layer dropped")
+
+	// Adding one waits for a frame that only depends on the base layer
+	assert.True(t, !client.forwardTemporal(src, frame(2), MaxTemporalLayer), "Layer added without a switching point")
+	sync := frameMarking{start: true, baseSync: true, tid: 2}
+	assert.True(t, client.forwardTemporal(src, sync, MaxTemporalLayer), "Layer not added at switching point")
+	assert.True(t, client.forwardTemporal(src, frame(1), MaxTemporalLayer), "Layer not added")
+}
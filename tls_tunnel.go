@@ -0,0 +1,329 @@
+package percy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// The tunnel between the MD and the KD from draft-ietf-perc-dtls-tunnel.
+// All associations share one TLS connection, and each one is identified to
+// the KD by a random UUID.
+//
+// https://tools.ietf.org/html/draft-ietf-perc-dtls-tunnel
+
+type tunnelMessageType uint8
+
+const (
+	tunnelSupportedProfiles tunnelMessageType = 1
+	tunnelMediaKeys         tunnelMessageType = 2
+	tunnelTunneledDTLS      tunnelMessageType = 3
+
+	tunnelHeaderSize = 3 // msg_type + length
+	tunnelVersion    = 0x00
+)
+
+func (mt tunnelMessageType) String() string {
+	switch mt {
+	case tunnelSupportedProfiles:
+		return "supported_profiles"
+	case tunnelMediaKeys:
+		return "media_keys"
+	case tunnelTunneledDTLS:
+		return "tunneled_dtls"
+	default:
+		return fmt.Sprintf("<0x%x>", uint8(mt))
+	}
+}
+
+type tunnelUUID [16]byte
+
+func newTunnelUUID() (tunnelUUID, error) {
+	var uuid tunnelUUID
+	_, err := rand.Read(uuid[:])
+	if err != nil {
+		return uuid, err
+	}
+
+	// https://tools.ietf.org/html/rfc4122#section-4.4
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return uuid, nil
+}
+
+type supportedProfiles struct {
+	Version  uint8
+	Profiles []ProtectionProfile `tls:"head=2"`
+}
+
+type mediaKeys struct {
+	UUID            tunnelUUID
+	Profile         ProtectionProfile
+	MKI             []byte `tls:"head=1"`
+	ClientWriteKey  []byte `tls:"head=1"`
+	ServerWriteKey  []byte `tls:"head=1"`
+	ClientWriteSalt []byte `tls:"head=1"`
+	ServerWriteSalt []byte `tls:"head=1"`
+}
+
+func (msg mediaKeys) keys() HBHKeys {
+	return HBHKeys{
+		Profile:         uint16(msg.Profile),
+		ClientWriteKey:  msg.ClientWriteKey,
+		ServerWriteKey:  msg.ServerWriteKey,
+		ClientWriteSalt: msg.ClientWriteSalt,
+		ServerWriteSalt: msg.ServerWriteSalt,
+	}
+}
+
+type tunneledDTLS struct {
+	UUID        tunnelUUID
+	DTLSMessage []byte `tls:"head=2"`
+}
+
+func writeTunnelMessage(w io.Writer, msgType tunnelMessageType, body interface{}) error {
+	data, err := syntax.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > 0xFFFF {
+		return fmt.Errorf("Tunnel message too long [%d]", len(data))
+	}
+
+	frame := make([]byte, tunnelHeaderSize+len(data))
+	frame[0] = byte(msgType)
+	frame[1] = byte(len(data) >> 8)
+	frame[2] = byte(len(data))
+	copy(frame[tunnelHeaderSize:], data)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+func readTunnelMessage(r io.Reader) (tunnelMessageType, []byte, error) {
+	header := make([]byte, tunnelHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	body := make([]byte, int(header[1])<<8|int(header[2]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return tunnelMessageType(header[0]), body, nil
+}
+
+//////////
+
+type TLSTunnel struct {
+	MD MDDTunnel
+
+	conn        net.Conn
+	writeMu     sync.Mutex
+	monitorOnce sync.Once
+	doneChan    chan bool
+
+	// uuids, assocs and stopped are guarded by mu
+	mu      sync.Mutex
+	uuids   map[AssociationID]tunnelUUID
+	assocs  map[tunnelUUID]AssociationID
+	stopped bool
+}
+
+func NewTLSTunnel(server string, config *tls.Config) (*TLSTunnel, error) {
+	conn, err := tls.Dial("tcp", server, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTLSTunnel(conn), nil
+}
+
+func newTLSTunnel(conn net.Conn) *TLSTunnel {
+	return &TLSTunnel{
+		conn:     conn,
+		doneChan: make(chan bool),
+		uuids:    map[AssociationID]tunnelUUID{},
+		assocs:   map[tunnelUUID]AssociationID{},
+	}
+}
+
+func (tun *TLSTunnel) lookupUUID(uuid tunnelUUID) (AssociationID, bool) {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+
+	assocID, ok := tun.assocs[uuid]
+	return assocID, ok
+}
+
+func (tun *TLSTunnel) monitor() {
+	defer close(tun.doneChan)
+
+	r := bufio.NewReader(tun.conn)
+	for {
+		msgType, body, err := readTunnelMessage(r)
+		if err != nil {
+			tun.mu.Lock()
+			stopped := tun.stopped
+			tun.mu.Unlock()
+
+			if !stopped {
+				log.Printf("Error reading KD tunnel: %v", err)
+			}
+			return
+		}
+
+		switch msgType {
+		case tunnelTunneledDTLS:
+			var msg tunneledDTLS
+			_, err = syntax.Unmarshal(body, &msg)
+			if err != nil {
+				log.Printf("Error parsing %v: %v", msgType, err)
+				continue
+			}
+
+			assocID, ok := tun.lookupUUID(msg.UUID)
+			if !ok {
+				log.Printf("MD <-- KD for unknown association %x", msg.UUID)
+				continue
+			}
+
+			log.Printf("MD <-- KD for %v with [%d] bytes", assocID, len(msg.DTLSMessage))
+
+			err = tun.MD.Send(assocID, msg.DTLSMessage)
+			if err != nil {
+				log.Printf("Error forwarding DTLS packet: %v", err)
+			}
+
+		case tunnelMediaKeys:
+			var msg mediaKeys
+			_, err = syntax.Unmarshal(body, &msg)
+			if err != nil {
+				log.Printf("Error parsing %v: %v", msgType, err)
+				continue
+			}
+
+			assocID, ok := tun.lookupUUID(msg.UUID)
+			if !ok {
+				log.Printf("Keys from KD for unknown association %x", msg.UUID)
+				continue
+			}
+
+			err = tun.MD.SetKeys(assocID, msg.keys())
+			if err != nil {
+				log.Printf("Error setting keys for %v: %v", assocID, err)
+			}
+
+		default:
+			log.Printf("Unexpected %v message from KD", msgType)
+		}
+	}
+}
+
+func (tun *TLSTunnel) uuid(assocID AssociationID) (tunnelUUID, error) {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+
+	if uuid, ok := tun.uuids[assocID]; ok {
+		return uuid, nil
+	}
+
+	uuid, err := newTunnelUUID()
+	if err != nil {
+		return uuid, err
+	}
+
+	tun.uuids[assocID] = uuid
+	tun.assocs[uuid] = assocID
+	return uuid, nil
+}
+
+func (tun *TLSTunnel) write(msgType tunnelMessageType, body interface{}) error {
+	tun.writeMu.Lock()
+	defer tun.writeMu.Unlock()
+
+	return writeTunnelMessage(tun.conn, msgType, body)
+}
+
+func (tun *TLSTunnel) Send(assocID AssociationID, msg []byte) error {
+	// Like the UDP forwarder, wait until there's something to send before
+	// listening, so that MD has been set
+	tun.monitorOnce.Do(func() { go tun.monitor() })
+
+	uuid, err := tun.uuid(assocID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("MD --> KD for %v with [%d] bytes", assocID, len(msg))
+
+	return tun.write(tunnelTunneledDTLS, &tunneledDTLS{UUID: uuid, DTLSMessage: msg})
+}
+
+// Send a DTLS record preceded by the list of profiles the MD supports, so
+// that the KD only negotiates one of them for this association
+func (tun *TLSTunnel) SendWithProfiles(assocID AssociationID, msg []byte, profiles []ProtectionProfile) error {
+	tun.monitorOnce.Do(func() { go tun.monitor() })
+
+	uuid, err := tun.uuid(assocID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("MD --> KD for %v with [%d] bytes and profiles %v", assocID, len(msg), profiles)
+
+	tun.writeMu.Lock()
+	defer tun.writeMu.Unlock()
+
+	sp := &supportedProfiles{Version: tunnelVersion, Profiles: profiles}
+	err = writeTunnelMessage(tun.conn, tunnelSupportedProfiles, sp)
+	if err != nil {
+		return err
+	}
+
+	return writeTunnelMessage(tun.conn, tunnelTunneledDTLS, &tunneledDTLS{UUID: uuid, DTLSMessage: msg})
+}
+
+// Forget about an association.  Anything the KD sends for it afterward is
+// dropped.
+func (tun *TLSTunnel) Close(assocID AssociationID) error {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+
+	uuid, ok := tun.uuids[assocID]
+	if !ok {
+		return nil
+	}
+
+	log.Printf("MD -x- KD for %v", assocID)
+
+	delete(tun.uuids, assocID)
+	delete(tun.assocs, uuid)
+	return nil
+}
+
+// Shut down the connection to the KD
+func (tun *TLSTunnel) Stop() {
+	tun.mu.Lock()
+	tun.stopped = true
+	tun.mu.Unlock()
+
+	tun.conn.Close()
+
+	started := true
+	tun.monitorOnce.Do(func() { started = false })
+	if started {
+		<-tun.doneChan
+	}
+}
@@ -0,0 +1,159 @@
+package percy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/bifurcation/mint/syntax"
+	"github.com/bifurcation/percy/assert"
+)
+
+type assocKeys struct {
+	assocID AssociationID
+	keys    HBHKeys
+}
+
+type keyedMDDChan struct {
+	MDDChan
+	keyChan chan assocKeys
+}
+
+func (mdd keyedMDDChan) SetKeys(assocID AssociationID, keys HBHKeys) error {
+	mdd.keyChan <- assocKeys{assocID, keys}
+	return nil
+}
+
+func TestTunnelMessageFraming(t *testing.T) {
+	in := &tunneledDTLS{
+		UUID:        tunnelUUID{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+		DTLSMessage: []byte{0x16, 0xfe, 0xfd},
+	}
+
+	buf := &bytes.Buffer{}
+	err := writeTunnelMessage(buf, tunnelTunneledDTLS, in)
+	assert.NotError(t, err, "Failed to write tunnel message")
+	assert.Equal(t, buf.Len(), tunnelHeaderSize+16+2+3, "Wrong frame length")
+
+	msgType, body, err := readTunnelMessage(buf)
+	assert.NotError(t, err, "Failed to read tunnel message")
+	assert.Equal(t, msgType, tunnelTunneledDTLS, "Wrong message type")
+
+	var out tunneledDTLS
+	_, err = syntax.Unmarshal(body, &out)
+	assert.NotError(t, err, "Failed to parse tunnel message")
+	assert.Equal(t, out.UUID, in.UUID, "Wrong UUID")
+	assert.BytesEqual(t, out.DTLSMessage, in.DTLSMessage, "Wrong DTLS message")
+
+	// Truncated body
+	buf.Reset()
+	writeTunnelMessage(buf, tunnelTunneledDTLS, in)
+	_, _, err = readTunnelMessage(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	assert.True(t, err != nil, "Read truncated tunnel message")
+}
+
+func TestTLSTunnel(t *testing.T) {
+	mdConn, kdConn := net.Pipe()
+	defer kdConn.Close()
+
+	md := keyedMDDChan{MDDChan: make(MDDChan), keyChan: make(chan assocKeys)}
+	tun := newTLSTunnel(mdConn)
+	tun.MD = md
+	defer tun.Stop()
+
+	assocID := AssociationID(5)
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+
+	sendErr := make(chan error)
+	go func() { sendErr <- tun.Send(assocID, hello) }()
+
+	// The KD sees the DTLS message under a fresh UUID
+	msgType, body, err := readTunnelMessage(kdConn)
+	assert.NotError(t, err, "KD failed to read tunnel message")
+	assert.Equal(t, msgType, tunnelTunneledDTLS, "Wrong message type")
+	assert.NotError(t, <-sendErr, "Failed to send to KD")
+
+	var fromMD tunneledDTLS
+	_, err = syntax.Unmarshal(body, &fromMD)
+	assert.NotError(t, err, "KD failed to parse tunnel message")
+	assert.BytesEqual(t, fromMD.DTLSMessage, hello, "Wrong DTLS message")
+	assert.NotEqual(t, fromMD.UUID, tunnelUUID{}, "Empty UUID")
+
+	// Responses from the KD are routed back to the same association
+	reply := &tunneledDTLS{UUID: fromMD.UUID, DTLSMessage: []byte{0x16, 0x01}}
+	go writeTunnelMessage(kdConn, tunnelTunneledDTLS, reply)
+	pkt := <-md.MDDChan
+	assert.Equal(t, pkt.assocID, assocID, "Wrong association for DTLS reply")
+	assert.BytesEqual(t, pkt.msg, reply.DTLSMessage, "Wrong DTLS reply")
+
+	keys := &mediaKeys{
+		UUID:            fromMD.UUID,
+		Profile:         ProtectionProfile(0x0008),
+		ClientWriteKey:  []byte{0x01, 0x02},
+		ServerWriteKey:  []byte{0x03, 0x04},
+		ClientWriteSalt: []byte{0x05},
+		ServerWriteSalt: []byte{0x06},
+	}
+	go writeTunnelMessage(kdConn, tunnelMediaKeys, keys)
+	ak := <-md.keyChan
+	assert.Equal(t, ak.assocID, assocID, "Wrong association for keys")
+	assert.Equal(t, ak.keys.Profile, uint16(0x0008), "Wrong profile")
+	assert.BytesEqual(t, ak.keys.ClientWriteKey, keys.ClientWriteKey, "Wrong client write key")
+	assert.BytesEqual(t, ak.keys.ServerWriteKey, keys.ServerWriteKey, "Wrong server write key")
+	assert.BytesEqual(t, ak.keys.ClientWriteSalt, keys.ClientWriteSalt, "Wrong client write salt")
+	assert.BytesEqual(t, ak.keys.ServerWriteSalt, keys.ServerWriteSalt, "Wrong server write salt")
+
+	// The same association keeps its UUID; a closed one gets a new one
+	go func() { sendErr <- tun.Send(assocID, hello) }()
+	_, body, _ = readTunnelMessage(kdConn)
+	assert.NotError(t, <-sendErr, "Failed to send to KD")
+	var again tunneledDTLS
+	syntax.Unmarshal(body, &again)
+	assert.Equal(t, again.UUID, fromMD.UUID, "UUID changed for live association")
+
+	tun.Close(assocID)
+	_, ok := tun.lookupUUID(fromMD.UUID)
+	assert.True(t, !ok, "UUID still mapped after close")
+
+	go func() { sendErr <- tun.Send(assocID, hello) }()
+	_, body, _ = readTunnelMessage(kdConn)
+	assert.NotError(t, <-sendErr, "Failed to send to KD")
+	syntax.Unmarshal(body, &again)
+	assert.NotEqual(t, again.UUID, fromMD.UUID, "UUID reused after close")
+}
+
+func TestTLSTunnelProfiles(t *testing.T) {
+	mdConn, kdConn := net.Pipe()
+	defer kdConn.Close()
+
+	tun := newTLSTunnel(mdConn)
+	tun.MD = make(MDDChan)
+	defer tun.Stop()
+
+	profiles := []ProtectionProfile{0x0009, 0x000a}
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00}
+
+	sendErr := make(chan error)
+	go func() { sendErr <- tun.SendWithProfiles(AssociationID(1), hello, profiles) }()
+
+	// The profiles arrive just ahead of the DTLS record
+	msgType, body, err := readTunnelMessage(kdConn)
+	assert.NotError(t, err, "KD failed to read tunnel message")
+	assert.Equal(t, msgType, tunnelSupportedProfiles, "Profiles not sent first")
+
+	var sp supportedProfiles
+	_, err = syntax.Unmarshal(body, &sp)
+	assert.NotError(t, err, "KD failed to parse profiles")
+	assert.Equal(t, sp.Version, uint8(tunnelVersion), "Wrong tunnel version")
+	assert.Equal(t, len(sp.Profiles), 2, "Wrong number of profiles")
+	assert.Equal(t, sp.Profiles[1], profiles[1], "Wrong profile")
+
+	msgType, body, err = readTunnelMessage(kdConn)
+	assert.NotError(t, err, "KD failed to read tunnel message")
+	assert.Equal(t, msgType, tunnelTunneledDTLS, "DTLS record not sent")
+	assert.NotError(t, <-sendErr, "Failed to send to KD")
+
+	var fromMD tunneledDTLS
+	syntax.Unmarshal(body, &fromMD)
+	assert.BytesEqual(t, fromMD.DTLSMessage, hello, "Wrong DTLS message")
+}
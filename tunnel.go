@@ -3,22 +3,27 @@ package percy
 import (
 	"log"
 	"net"
+	"sync"
 
 	"github.com/bifurcation/mint/syntax"
 )
 
 type ProtectionProfile uint16
 
+// Hop-by-hop SRTP keying material for an association, as provided by
+// the KD
 type HBHKeys struct {
-	Marker         uint8
-	Profile        uint16
-	ClientWriteKey []byte `tls:"head=1"`
-	ServerWriteKey []byte `tls:"head=1"`
-	MasterSalt     []byte `tls:"head=1"`
+	Profile         uint16
+	ClientWriteKey  []byte
+	ServerWriteKey  []byte
+	ClientWriteSalt []byte
+	ServerWriteSalt []byte
 }
 
 type KMFTunnel interface {
 	Send(assoc AssociationID, msg []byte) error
+	SendWithProfiles(assoc AssociationID, msg []byte, profiles []ProtectionProfile) error
+	Close(assoc AssociationID) error
 }
 
 type MDDTunnel interface {
@@ -32,10 +37,33 @@ const (
 	kdBufferSize = 2048
 )
 
+// Keys from the KD arrive on the UDP socket in this format, marked by
+// a leading 0xFF byte.  The same salt is used in both directions.
+type udpKeyMessage struct {
+	Marker         uint8
+	Profile        uint16
+	ClientWriteKey []byte `tls:"head=1"`
+	ServerWriteKey []byte `tls:"head=1"`
+	MasterSalt     []byte `tls:"head=1"`
+}
+
+func (msg udpKeyMessage) keys() HBHKeys {
+	return HBHKeys{
+		Profile:         msg.Profile,
+		ClientWriteKey:  msg.ClientWriteKey,
+		ServerWriteKey:  msg.ServerWriteKey,
+		ClientWriteSalt: msg.MasterSalt,
+		ServerWriteSalt: msg.MasterSalt,
+	}
+}
+
 type UDPForwarder struct {
 	MD     MDDTunnel
 	server *net.UDPAddr
-	conns  map[AssociationID]*net.UDPConn
+
+	// conns is guarded by mu; each connection has its own monitor goroutine
+	mu    sync.Mutex
+	conns map[AssociationID]*net.UDPConn
 }
 
 func NewUDPForwarder(server string) (*UDPForwarder, error) {
@@ -56,40 +84,50 @@ func (fwd *UDPForwarder) monitor(assocID AssociationID, conn *net.UDPConn) {
 	for {
 		n, _, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			log.Printf("Error reading KD socket: %v", err)
+			fwd.mu.Lock()
+			current := fwd.conns[assocID]
+			fwd.mu.Unlock()
+
+			// Don't complain about sockets closed by Close
+			if current == conn {
+				log.Printf("Error reading KD socket: %v", err)
+			}
 			return
 		}
-		buf = buf[:n]
 
-		log.Printf("MD <-- KD for %v with [%d] bytes", assocID, len(buf))
+		// The MD may hold on to the message, so hand it a copy
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+
+		log.Printf("MD <-- KD for %v with [%d] bytes", assocID, len(msg))
 
-		switch packetClass(buf) {
+		switch packetClass(msg) {
 		case packetClassDTLS:
-			err = fwd.MD.Send(assocID, buf)
+			err = fwd.MD.Send(assocID, msg)
 			if err != nil {
 				log.Printf("Error forwarding DTLS packet: %v", err)
 			}
 
 		case packetClassHBHKey:
-			var keys HBHKeys
-			_, err := syntax.Unmarshal(buf, &keys)
+			var keyMsg udpKeyMessage
+			_, err := syntax.Unmarshal(msg, &keyMsg)
 			if err != nil {
 				log.Printf("Error parsing HBHKeys struct: %v", err)
 			}
 
-			fwd.MD.SetKeys(assocID, keys)
+			fwd.MD.SetKeys(assocID, keyMsg.keys())
 		}
-
-		buf = buf[:kdBufferSize]
 	}
 }
 
 func (fwd *UDPForwarder) Send(assocID AssociationID, msg []byte) error {
 	var err error
+	fwd.mu.Lock()
 	conn, ok := fwd.conns[assocID]
 	if !ok {
 		conn, err = net.DialUDP("udp", nil, fwd.server)
 		if err != nil {
+			fwd.mu.Unlock()
 			return err
 		}
 
@@ -98,9 +136,31 @@ func (fwd *UDPForwarder) Send(assocID AssociationID, msg []byte) error {
 		fwd.conns[assocID] = conn
 		go fwd.monitor(assocID, conn)
 	}
+	fwd.mu.Unlock()
 
 	log.Printf("MD --> KD for %v with [%d] bytes", assocID, len(msg))
 
 	_, err = conn.Write(msg)
 	return err
 }
+
+// The UDP tunnel has no way to carry the MD's profiles, so the KD is
+// expected to be configured with them out of band.
+func (fwd *UDPForwarder) SendWithProfiles(assocID AssociationID, msg []byte, profiles []ProtectionProfile) error {
+	return fwd.Send(assocID, msg)
+}
+
+// Forget about an association and close its socket to the KD
+func (fwd *UDPForwarder) Close(assocID AssociationID) error {
+	fwd.mu.Lock()
+	conn, ok := fwd.conns[assocID]
+	delete(fwd.conns, assocID)
+	fwd.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	log.Printf("MD -x- KD for %v", assocID)
+	return conn.Close()
+}
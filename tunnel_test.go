@@ -17,21 +17,21 @@ func NewKdEchoServer(port int) (*KdEchoServer, error) {
 		return nil, err
 	}
 
-	stopped := false
 	stopChan := make(chan bool)
 	packetChan := make(chan packet)
 
 	go func() {
 		buf := make([]byte, 2048)
 
-		for !stopped {
+		for {
 			n, addr, err := conn.ReadFromUDP(buf)
 			if err != nil {
-				continue
+				return
 			}
 
-			buf = buf[:n]
-			packetChan <- packet{addr: addr, msg: buf[:n]}
+			msg := make([]byte, n)
+			copy(msg, buf[:n])
+			packetChan <- packet{addr: addr, msg: msg}
 		}
 	}()
 
@@ -110,3 +110,84 @@ func TestUDPForwarder(t *testing.T) {
 
 	echo.Stop()
 }
+
+func TestUDPForwarderConcurrent(t *testing.T) {
+	port := 2001
+	server := "localhost:2001"
+
+	md := make(MDDChan)
+	echo, err := NewKdEchoServer(port)
+	if err != nil {
+		t.Fatalf("Error creating kd echo server: %v", err)
+	}
+	defer echo.Stop()
+
+	fwd, err := NewUDPForwarder(server)
+	if err != nil {
+		t.Fatalf("Error creating echo server: %v", err)
+	}
+
+	fwd.MD = md
+
+	// Several associations sending at once share the connection map
+	nAssocs := 8
+	nRounds := 5
+	for i := 0; i < nRounds; i += 1 {
+		for j := 0; j < nAssocs; j += 1 {
+			go func(assocID AssociationID) {
+				fwd.Send(assocID, []byte{0x14, byte(assocID)})
+			}(AssociationID(j))
+		}
+
+		for j := 0; j < nAssocs; j += 1 {
+			pkt := <-md
+			msgOut := []byte{0x14, byte(pkt.assocID), 0x01}
+			if !bytes.Equal(pkt.msg, msgOut) {
+				t.Fatalf("Incorrect packet message: %x != %x", pkt.msg, msgOut)
+			}
+		}
+	}
+}
+
+func TestUDPForwarderClose(t *testing.T) {
+	port := 2002
+	server := "localhost:2002"
+
+	md := make(MDDChan)
+	echo, err := NewKdEchoServer(port)
+	if err != nil {
+		t.Fatalf("Error creating kd echo server: %v", err)
+	}
+	defer echo.Stop()
+
+	fwd, err := NewUDPForwarder(server)
+	if err != nil {
+		t.Fatalf("Error creating echo server: %v", err)
+	}
+
+	fwd.MD = md
+
+	var assocID AssociationID = 1
+	fwd.Send(assocID, []byte{0x14, 0x00})
+	<-md
+
+	err = fwd.Close(assocID)
+	if err != nil {
+		t.Fatalf("Error closing association: %v", err)
+	}
+	if len(fwd.conns) != 0 {
+		t.Fatalf("Connection not removed on close")
+	}
+
+	// Closing twice is harmless, and the association can come back
+	err = fwd.Close(assocID)
+	if err != nil {
+		t.Fatalf("Error closing association twice: %v", err)
+	}
+
+	fwd.Send(assocID, []byte{0x14, 0x00})
+	pkt := <-md
+	if pkt.assocID != assocID {
+		t.Fatalf("Incorrect association ID: %04x != %04x", pkt.assocID, assocID)
+	}
+}